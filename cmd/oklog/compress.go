@@ -0,0 +1,140 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+
+	"github.com/oklog/oklog/pkg/ingest"
+)
+
+const defaultCompressFlushInterval = 100 * time.Millisecond
+
+// openRecords writes the hello to w, and returns the writer for the records
+// that follow, which compresses them if the hello requested it. Each write to
+// it is a record; written, if not nil, is called with the number of records
+// written through to w, once they are, which for compressed records is when
+// they're flushed. Closing it flushes anything buffered, but doesn't close w.
+func openRecords(w io.Writer, hello []string, flush time.Duration, written func(n int)) (io.WriteCloser, error) {
+	if len(hello) > 0 {
+		if err := ingest.WriteHello(w, hello...); err != nil {
+			return nil, err
+		}
+	}
+	if written == nil {
+		written = func(int) {}
+	}
+	for _, option := range hello {
+		if option == ingest.HelloCompress+"="+ingest.CompressSnappy {
+			return newCompressWriter(w, flush, written), nil
+		}
+	}
+	return recordWriter{w, written}, nil
+}
+
+// parseCompress validates the -compress flag, returning the hello option
+// requesting it, if any.
+func parseCompress(codec string) ([]string, bool) {
+	switch strings.ToLower(codec) {
+	case "", "none":
+		return nil, true
+	case ingest.CompressSnappy:
+		return []string{ingest.HelloCompress + "=" + ingest.CompressSnappy}, true
+	default:
+		return nil, false
+	}
+}
+
+// compressWriter compresses records with snappy, flushing them at least
+// every interval, so they aren't held back for long while input is slow.
+type compressWriter struct {
+	mtx     sync.Mutex
+	w       *snappy.Writer
+	dirty   bool
+	records int // written since the last flush
+	written func(n int)
+	err     error
+	quit    chan struct{}
+}
+
+func newCompressWriter(w io.Writer, interval time.Duration, written func(n int)) *compressWriter {
+	c := &compressWriter{
+		w:       snappy.NewBufferedWriter(w),
+		written: written,
+		quit:    make(chan struct{}),
+	}
+	go c.loop(interval)
+	return c
+}
+
+func (c *compressWriter) Write(p []byte) (int, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.dirty, c.err = true, err
+	if err == nil {
+		c.records++
+	}
+	return n, err
+}
+
+func (c *compressWriter) loop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.mtx.Lock()
+			if c.dirty && c.err == nil {
+				c.dirty, c.err = false, c.w.Flush()
+				c.flushed()
+			}
+			c.mtx.Unlock()
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+// Close flushes anything buffered, and stops the periodic flushes.
+func (c *compressWriter) Close() error {
+	close(c.quit)
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	c.dirty, c.err = false, c.w.Close()
+	c.flushed()
+	return c.err
+}
+
+// flushed reports the records written since the last flush, if it succeeded.
+func (c *compressWriter) flushed() {
+	if c.err == nil && c.records > 0 {
+		c.written(c.records)
+		c.records = 0
+	}
+}
+
+// recordWriter writes records straight through to w.
+type recordWriter struct {
+	w       io.Writer
+	written func(n int)
+}
+
+func (r recordWriter) Write(p []byte) (int, error) {
+	n, err := r.w.Write(p)
+	if err == nil {
+		r.written(1)
+	}
+	return n, err
+}
+
+func (recordWriter) Close() error { return nil }
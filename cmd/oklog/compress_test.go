@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+
+	"github.com/oklog/oklog/pkg/ingest"
+)
+
+func TestOpenRecordsCompressed(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	hello, ok := parseCompress("snappy")
+	if !ok {
+		t.Fatal("snappy unsupported")
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		w, err := openRecords(client, hello, 10*time.Millisecond, nil)
+		if err != nil {
+			done <- err
+			return
+		}
+		if _, err := w.Write([]byte("a one\n")); err != nil {
+			done <- err
+			return
+		}
+		done <- nil
+	}()
+
+	// The hello is plain; the record after it arrives compressed, flushed
+	// without closing the writer.
+	br := bufio.NewReader(server)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := ingest.HelloPrefix + " " + ingest.HelloCompress + "=" + ingest.CompressSnappy + "\n"; want != line {
+		t.Fatalf("hello: want %q, have %q", want, line)
+	}
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	rec, err := bufio.NewReader(snappy.NewReader(br)).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "a one\n"; want != rec {
+		t.Errorf("want %q, have %q", want, rec)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := parseCompress("lzma"); ok {
+		t.Error("want lzma unsupported")
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/oklog/oklog/pkg/cluster"
+)
+
+// joinCluster joins the cluster via the peers, as a forwarder, which serves
+// nothing to other peers, but learns about the ingesters.
+func joinCluster(bindAddr, advertiseAddr string, peers []string, apiPort int, logger log.Logger) (*cluster.Peer, error) {
+	_, _, bindHost, bindPort, err := parseAddr(bindAddr, 0) // any free port
+	if err != nil {
+		return nil, err
+	}
+	var (
+		advertiseHost string
+		advertisePort int
+	)
+	if advertiseAddr != "" {
+		_, _, advertiseHost, advertisePort, err = parseAddr(advertiseAddr, 0) // the bind port
+		if err != nil {
+			return nil, err
+		}
+	}
+	advertiseIP, err := cluster.CalculateAdvertiseIP(bindHost, advertiseHost, net.DefaultResolver, logger)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't deduce an advertise IP: %v", err)
+	}
+	if hasNonlocal(peers) && isUnroutable(advertiseIP.String()) {
+		level.Warn(logger).Log("err", "this node advertises itself on an unroutable IP", "ip", advertiseIP.String())
+		level.Warn(logger).Log("err", "provide -cluster.advertise-addr as a routable IP address or hostname")
+	}
+	if advertisePort == 0 {
+		advertisePort = bindPort
+	}
+	level.Info(logger).Log("cluster_bind", net.JoinHostPort(bindHost, strconv.Itoa(bindPort)), "cluster_advertise", net.JoinHostPort(advertiseIP.String(), strconv.Itoa(advertisePort)))
+	return cluster.NewPeer(
+		bindHost, bindPort,
+		advertiseIP.String(), advertisePort,
+		peers,
+		cluster.PeerTypeForward, apiPort,
+		log.With(logger, "component", "cluster"),
+	)
+}
+
+// pickIngester returns the host:port of a random ingester, for the listener
+// chosen by port, or defaultPort if the ingester doesn't advertise it.
+// Ingesters that are draining, or whose disks are full, are skipped, and
+// those shedding load are avoided while there are others.
+func pickIngester(ingesters map[string]cluster.Ingester, port func(cluster.IngestPorts) int, defaultPort int) (string, bool) {
+	var preferred, shedding []string
+	for _, i := range ingesters {
+		if i.Load != nil && (i.Load.Draining || i.Load.DiskFull) {
+			continue
+		}
+		p := defaultPort
+		if i.Ports != nil && port(*i.Ports) > 0 {
+			p = port(*i.Ports)
+		}
+		addr := net.JoinHostPort(i.Host, strconv.Itoa(p))
+		if i.Load != nil && i.Load.Shedding {
+			shedding = append(shedding, addr)
+		} else {
+			preferred = append(preferred, addr)
+		}
+	}
+	if len(preferred) <= 0 {
+		preferred = shedding
+	}
+	if len(preferred) <= 0 {
+		return "", false
+	}
+	return preferred[rand.Intn(len(preferred))], true
+}
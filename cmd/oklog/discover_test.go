@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/oklog/oklog/pkg/cluster"
+)
+
+func TestPickIngester(t *testing.T) {
+	var (
+		bulk  = func(p cluster.IngestPorts) int { return p.Bulk }
+		ports = &cluster.IngestPorts{Fast: 1, Durable: 2, Bulk: 3}
+	)
+	for _, testcase := range []struct {
+		name      string
+		ingesters map[string]cluster.Ingester
+		want      string
+	}{
+		{
+			name: "advertised port",
+			ingesters: map[string]cluster.Ingester{
+				"a": {Host: "10.0.0.1", Ports: ports},
+			},
+			want: "10.0.0.1:3",
+		},
+		{
+			name: "default port",
+			ingesters: map[string]cluster.Ingester{
+				"a": {Host: "10.0.0.1"},
+			},
+			want: "10.0.0.1:7653",
+		},
+		{
+			name: "skip draining and full",
+			ingesters: map[string]cluster.Ingester{
+				"a": {Host: "10.0.0.1", Ports: ports, Load: &cluster.Load{Draining: true}},
+				"b": {Host: "10.0.0.2", Ports: ports, Load: &cluster.Load{DiskFull: true}},
+				"c": {Host: "10.0.0.3", Ports: ports, Load: &cluster.Load{Shedding: true}},
+			},
+			want: "10.0.0.3:3",
+		},
+		{
+			name: "avoid shedding",
+			ingesters: map[string]cluster.Ingester{
+				"a": {Host: "10.0.0.1", Ports: ports, Load: &cluster.Load{Shedding: true}},
+				"b": {Host: "10.0.0.2", Ports: ports, Load: &cluster.Load{}},
+			},
+			want: "10.0.0.2:3",
+		},
+		{
+			name: "none",
+			ingesters: map[string]cluster.Ingester{
+				"a": {Host: "10.0.0.1", Ports: ports, Load: &cluster.Load{Draining: true}},
+			},
+			want: "",
+		},
+	} {
+		for i := 0; i < 10; i++ { // picks are random
+			have, ok := pickIngester(testcase.ingesters, bulk, defaultBulkPort)
+			if ok != (testcase.want != "") || have != testcase.want {
+				t.Errorf("%s: want %q, have %q", testcase.name, testcase.want, have)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import "os"
+
+// drainSignals start draining an ingester. There are none on this platform,
+// so drains must be started via the API.
+var drainSignals []os.Signal
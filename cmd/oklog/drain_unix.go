@@ -0,0 +1,12 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// drainSignals start draining an ingester.
+var drainSignals = []os.Signal{syscall.SIGUSR1}
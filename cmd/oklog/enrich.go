@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-logfmt/logfmt"
+	"github.com/pkg/errors"
+)
+
+// enricher describes this forwarder, as logfmt key=value pairs added to each
+// record, so hostnames, pod names, and the like needn't be templated into
+// -prefix flags. Values are read once, at startup.
+type enricher struct {
+	hostname bool
+	pid      bool
+	env      []string // NAME, or key=NAME
+	k8sDir   string   // of a Kubernetes downward API volume
+	k8sKeys  []string // of the labels and annotations to add
+}
+
+// pairs returns the key=value pairs, in a consistent order: host, pid, the
+// environment variables as given, then the downward API files by name.
+func (e enricher) pairs() (string, error) {
+	var keyvals []interface{}
+	if e.hostname {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return "", err
+		}
+		keyvals = append(keyvals, "host", hostname)
+	}
+	if e.pid {
+		keyvals = append(keyvals, "pid", os.Getpid())
+	}
+	for _, env := range e.env {
+		key, name := env, env
+		if i := strings.IndexByte(env, '='); i >= 0 {
+			key, name = env[:i], env[i+1:]
+		}
+		if key == "" || name == "" {
+			return "", fmt.Errorf("-enrich.env %q invalid, must be NAME or key=NAME", env)
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("-enrich.env %q: %s isn't set", env, name)
+		}
+		keyvals = append(keyvals, key, value)
+	}
+	if e.k8sDir != "" {
+		kv, err := readDownwardAPI(e.k8sDir, e.k8sKeys)
+		if err != nil {
+			return "", errors.Wrap(err, "reading -enrich.k8s-dir")
+		}
+		keyvals = append(keyvals, kv...)
+	}
+	if len(keyvals) <= 0 {
+		return "", nil
+	}
+	b, err := logfmt.MarshalKeyvals(keyvals...)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// downwardAPIPair matches the lines of labels and annotations files, e.g.
+// app="web".
+var downwardAPIPair = regexp.MustCompile(`^([^=\s]+)=("(?:[^"\\]|\\.)*")$`)
+
+// readDownwardAPI returns key=value pairs from the files of a Kubernetes
+// downward API volume. A file holding a single value, e.g. namespace, is
+// k8s_namespace=value; one holding key="value" lines, e.g. labels, is a
+// k8s_labels_key=value pair for each line with one of the given keys. Other
+// lines are skipped, as annotations in particular may be large, e.g. the
+// last applied configuration, or sensitive.
+func readDownwardAPI(dir string, keys []string) ([]interface{}, error) {
+	include := map[string]bool{}
+	for _, key := range keys {
+		include[key] = true
+	}
+
+	entries, err := ioutil.ReadDir(dir) // sorted by name
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue // e.g. ..data, which the volume's files link into
+		}
+		if fi, err := os.Stat(filepath.Join(dir, entry.Name())); err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+
+	var keyvals []interface{}
+	for _, name := range names {
+		buf, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		key := "k8s_" + name
+		if pairs, ok := parseDownwardAPIPairs(string(buf)); ok {
+			for _, pair := range pairs {
+				if include[pair[0]] {
+					keyvals = append(keyvals, key+"_"+pair[0], pair[1])
+				}
+			}
+			continue
+		}
+		keyvals = append(keyvals, key, strings.TrimSpace(string(buf)))
+	}
+	return keyvals, nil
+}
+
+// parseDownwardAPIPairs parses s as key="value" lines, if every line is one.
+func parseDownwardAPIPairs(s string) ([][2]string, bool) {
+	var (
+		pairs [][2]string
+		sc    = bufio.NewScanner(strings.NewReader(s))
+	)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		m := downwardAPIPair.FindStringSubmatch(line)
+		if m == nil {
+			return nil, false
+		}
+		value, err := strconv.Unquote(m[2])
+		if err != nil {
+			return nil, false
+		}
+		pairs = append(pairs, [2]string{m[1], value})
+	}
+	return pairs, len(pairs) > 0
+}
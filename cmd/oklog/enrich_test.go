@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestEnricher(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"namespace":   "prod\n",
+		"labels":      "app=\"web\"\ntier=\"front end\"\npod-template-hash=\"5d4f\"\n",
+		"annotations": "note=\"say \\\"hi\\\"\"\nkubectl.kubernetes.io/last-applied-configuration=\"{}\"\n",
+		".hidden":     "x\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Setenv("OKLOG_TEST_POD", "web-1")
+	defer os.Unsetenv("OKLOG_TEST_POD")
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	have, err := enricher{
+		hostname: true,
+		pid:      true,
+		env:      []string{"pod=OKLOG_TEST_POD", "OKLOG_TEST_POD"},
+		k8sDir:   dir,
+		k8sKeys:  []string{"app", "note", "tier"},
+	}.pairs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "host=" + hostname + " pid=" + strconv.Itoa(os.Getpid()) +
+		" pod=web-1 OKLOG_TEST_POD=web-1" +
+		` k8s_annotations_note="say \"hi\""` +
+		` k8s_labels_app=web k8s_labels_tier="front end"` +
+		" k8s_namespace=prod"
+	if want != have {
+		t.Errorf("want %q, have %q", want, have)
+	}
+
+	if _, err := (enricher{env: []string{"OKLOG_TEST_UNSET"}}).pairs(); err == nil {
+		t.Error("want error for an unset variable, have none")
+	}
+	if have, err := (enricher{}).pairs(); err != nil || have != "" {
+		t.Errorf("want no pairs, have %q, %v", have, err)
+	}
+}
@@ -4,35 +4,91 @@ import (
 	"bufio"
 	"flag"
 	"fmt"
+	"io"
 	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/oklog/oklog/pkg/cluster"
+	"github.com/oklog/oklog/pkg/ingest"
+	"github.com/oklog/oklog/pkg/record"
+)
+
+const (
+	defaultBulkMaxSize = 4 * 1024 * 1024
+	defaultBulkMaxAge  = time.Second
 )
 
 func runForward(args []string) error {
 	flagset := flag.NewFlagSet("forward", flag.ExitOnError)
 	var (
-		debug    = flagset.Bool("debug", false, "debug logging")
-		apiAddr  = flagset.String("api", "", "listen address for forward API (and metrics)")
-		prefixes = stringslice{}
+		debug         = flagset.Bool("debug", false, "debug logging")
+		apiAddr       = flagset.String("api", "", "listen address for forward API (and metrics)")
+		useTLS        = flagset.Bool("tls", false, "connect to ingesters via TLS")
+		tlsCert       = flagset.String("tls.cert", "", "optional, client certificate file for mutual TLS (implies -tls)")
+		tlsKey        = flagset.String("tls.key", "", "optional, client key file for mutual TLS (implies -tls)")
+		tlsCA         = flagset.String("tls.ca", "", "optional, CA bundle to verify ingesters (implies -tls)")
+		tlsServerName = flagset.String("tls.server-name", "", "optional, server name to verify ingesters against")
+		ack           = flagset.Bool("ack", false, "request acks, and resend unacked records after reconnecting (use with the durable port)")
+		ackWindowSize = flagset.Int("ack.window", 1024, "maximum number of unacked records in flight (requires -ack)")
+		bulk          = flagset.Bool("bulk", false, "ship records in batches, each acked as a whole, to the bulk port")
+		bulkMaxSize   = flagset.Int("bulk.max-size", defaultBulkMaxSize, "ship a batch before it grows past this many bytes, as written by the ingester (requires -bulk)")
+		bulkMaxAge    = flagset.Duration("bulk.max-age", defaultBulkMaxAge, "ship a batch once its first record is this old (requires -bulk)")
+		producer      = flagset.String("producer", "", "optional, name of this forwarder; records are tagged with it and sequence numbers, so redelivered records are dropped as duplicates")
+		mlTimeout     = flagset.Duration("multiline.timeout", defaultMultilineTimeout, "emit a multiline record after no more lines for this long")
+		mlMaxSize     = flagset.Int("multiline.max-size", defaultIngestRecordMaxSize, "emit a multiline record before it grows past this many bytes")
+		spoolDir      = flagset.String("spool.dir", "", "optional, directory to spool records in while no ingester is reachable; by default, input blocks")
+		spoolMaxSize  = flagset.Int64("spool.max-size", defaultSpoolMaxSize, "maximum bytes of records to spool (requires -spool.dir)")
+		spoolPolicy   = flagset.String("spool.overflow", string(spoolBlock), "when the spool is full: block, drop-oldest (requires -spool.dir)")
+		filePoll      = flagset.Duration("file.poll", defaultFilePollInterval, "how often to check tailed files for new records, and new files (requires -file)")
+		fileCkpt      = flagset.String("file.checkpoint", "", "optional, file to save read offsets in, so tailing resumes where it stopped after a restart (requires -file)")
+		clusterBind   = flagset.String("cluster", defaultForwardClusterAddr, "listen address for cluster, by default on any free port (requires -peer)")
+		clusterAdv    = flagset.String("cluster.advertise-addr", "", "optional, explicit address to advertise in cluster (requires -peer)")
+		ringSize      = flagset.Int("ring.size", 0, "optional, spool up to this many records in memory instead, dropping the oldest when the spool is full, so input never blocks")
+		redactFile    = flagset.String("redact.file", "", "optional, file of rules masking or hashing sensitive data, e.g. card numbers, in records before they're forwarded")
+		routeFile     = flagset.String("route.file", "", "optional, file of rules picking a topic for each record, which is prepended, for ingesters in dynamic topic mode")
+		compress      = flagset.String("compress", "", "optional, compress records sent to ingesters: snappy")
+		enrichHost    = flagset.Bool("enrich.hostname", false, "add host=<hostname> to each record")
+		enrichPID     = flagset.Bool("enrich.pid", false, "add pid=<forwarder PID> to each record")
+		enrichK8sDir  = flagset.String("enrich.k8s-dir", "", "optional, Kubernetes downward API volume; add k8s_<file>=<value> to each record, and k8s_<file>_<key>=<value> for labels and annotations given by -enrich.k8s-key")
+		compressFlush = flagset.Duration("compress.flush", defaultCompressFlushInterval, "flush compressed records at least this often (requires -compress)")
+		prefixes      = stringslice{}
+		mlStart       = stringslice{}
+		files         = stringslice{}
+		clusterPeers  = stringslice{}
+		enrichEnv     = stringslice{}
+		enrichK8sKeys = stringslice{}
 	)
+	flagset.Var(&clusterPeers, "peer", "cluster peer host:port to join, to discover ingesters, instead of taking them as arguments (repeatable)")
+	flagset.Var(&files, "file", "glob pattern of files to tail instead of stdin, optionally followed by a space and a prefix for their records, e.g. a topic, which goes first (repeatable; not with -route.file)")
 	flagset.Var(&prefixes, "prefix", "prefix annotated on each log record (repeatable)")
-	flagset.Usage = usageFor(flagset, "oklog forward [flags] <ingester> [<ingester>...]")
+	flagset.Var(&enrichEnv, "enrich.env", "environment variable to add to each record, as NAME=<value>, or key=NAME to add key=<value> (repeatable)")
+	flagset.Var(&enrichK8sKeys, "enrich.k8s-key", "label or annotation key to add from -enrich.k8s-dir, e.g. app; others are left out (repeatable)")
+	flagset.Var(&mlStart, "multiline.start", "optional, regexp matching the first line of a record; other lines are joined onto the record before them (repeatable)")
+	flagset.Usage = usageFor(flagset, "oklog forward [flags] <ingester> [<ingester>...]\n  oklog forward [flags] -peer <host:port> [-peer <host:port>...]")
 	if err := flagset.Parse(args); err != nil {
 		return err
 	}
 	args = flagset.Args()
-	if len(args) <= 0 {
-		return errors.New("specify at least one ingest address as an argument")
+	if len(args) <= 0 && len(clusterPeers) <= 0 {
+		return errors.New("specify at least one ingest address as an argument, or -peer")
+	}
+	if len(args) > 0 && len(clusterPeers) > 0 {
+		return errors.New("specify ingest addresses as arguments, or -peer, but not both")
 	}
 
 	// Logging.
@@ -68,16 +124,59 @@ func runForward(args []string) error {
 		Name:      "forward_short_writes",
 		Help:      "Number of times forwarder performs a short write to the ingester.",
 	})
+	resentRecords := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "oklog",
+		Name:      "forward_resent_records_total",
+		Help:      "Unacked records resent after reconnecting (requires -ack).",
+	})
+	spoolRecords := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "oklog",
+		Name:      "forward_spool_records",
+		Help:      "Records held in the spool (requires -spool.dir or -ring.size).",
+	})
+	spoolBytes := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "oklog",
+		Name:      "forward_spool_bytes",
+		Help:      "Bytes of records held in the spool (requires -spool.dir or -ring.size).",
+	})
+	spoolDropped := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "oklog",
+		Name:      "forward_spool_dropped_records_total",
+		Help:      "Records dropped from a full spool, under the drop-oldest policy, or with -ring.size.",
+	})
+	routedRecords := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "oklog",
+		Name:      "forward_routed_records_total",
+		Help:      "Records routed to each topic (requires -route.file).",
+	}, []string{"topic"})
+	splitRecords := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "oklog",
+		Name:      "forward_split_records_total",
+		Help:      "Input lines split because they're over the maximum record size.",
+	})
+	redactions := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "oklog",
+		Name:      "forward_redactions_total",
+		Help:      "Sensitive values masked or hashed in records, by redaction rule (requires -redact.file).",
+	}, []string{"rule"})
 	prometheus.MustRegister(
 		forwardBytes,
 		forwardRecords,
 		disconnects,
 		shortWrites,
+		resentRecords,
+		spoolRecords,
+		spoolBytes,
+		spoolDropped,
+		routedRecords,
+		redactions,
+		splitRecords,
 	)
 
 	// For now, just a quick-and-dirty metrics server.
+	var apiPort int
 	if *apiAddr != "" {
-		apiNetwork, apiAddress, _, _, err := parseAddr(*apiAddr, defaultAPIPort)
+		apiNetwork, apiAddress, _, port, err := parseAddr(*apiAddr, defaultAPIPort)
 		if err != nil {
 			return err
 		}
@@ -85,6 +184,7 @@ func runForward(args []string) error {
 		if err != nil {
 			return err
 		}
+		apiPort = port
 		go func() {
 			mux := http.NewServeMux()
 			registerMetrics(mux)
@@ -95,9 +195,13 @@ func runForward(args []string) error {
 	}
 
 	// Parse URLs for forwarders.
+	defaultPort := defaultFastPort
+	if *bulk {
+		defaultPort = defaultBulkPort
+	}
 	var urls []*url.URL
 	for _, addr := range args {
-		schema, host, _, _, err := parseAddr(addr, defaultFastPort)
+		schema, host, _, _, err := parseAddr(addr, defaultPort)
 		if err != nil {
 			return errors.Wrap(err, "parsing ingest address")
 		}
@@ -111,12 +215,123 @@ func runForward(args []string) error {
 		urls = append(urls, u)
 	}
 
+	// Or discover them via the cluster, and pick the listener for our mode.
+	var (
+		peer       *cluster.Peer
+		ingestPort = func(p cluster.IngestPorts) int { return p.Fast }
+	)
+	if len(clusterPeers) > 0 {
+		switch {
+		case *bulk:
+			ingestPort = func(p cluster.IngestPorts) int { return p.Bulk }
+		case *ack:
+			ingestPort, defaultPort = func(p cluster.IngestPorts) int { return p.Durable }, defaultDurablePort
+		}
+		var err error
+		peer, err = joinCluster(*clusterBind, *clusterAdv, clusterPeers, apiPort, logger)
+		if err != nil {
+			return errors.Wrap(err, "joining cluster")
+		}
+		defer peer.Leave(time.Second)
+	}
+
+	// Build the dialer. With TLS, every connection is verified against the CA
+	// bundle, and presents the client certificate if one was given.
+	dial := net.Dial
+	if *useTLS || *tlsCert != "" || *tlsKey != "" || *tlsCA != "" {
+		tlsConfig, err := newClientTLSConfig(*tlsCert, *tlsKey, *tlsCA, *tlsServerName)
+		if err != nil {
+			return err
+		}
+		dial = tlsDialer(tlsConfig)
+	}
+
+	// Describe this forwarder after the prefixes, e.g. host=web-1 pid=42.
+	enrichment, err := enricher{
+		hostname: *enrichHost,
+		pid:      *enrichPID,
+		env:      enrichEnv,
+		k8sDir:   *enrichK8sDir,
+		k8sKeys:  enrichK8sKeys,
+	}.pairs()
+	if err != nil {
+		return err
+	}
+	if enrichment != "" {
+		prefixes = append(prefixes, enrichment)
+	}
+
 	// Construct the prefix expression.
 	var prefix string
 	if len(prefixes) > 0 {
 		prefix = strings.Join(prefixes, " ") + " "
 	}
 
+	// Tag records with a producer ID and sequence numbers, so ingesters and
+	// stores can drop records redelivered after reconnecting.
+	var (
+		hello []string
+		seqr  *sequencer
+	)
+	if *producer != "" {
+		if strings.ContainsAny(*producer, " \t\n=") {
+			return fmt.Errorf("producer %q invalid, must not contain whitespace or =", *producer)
+		}
+		hello = []string{
+			ingest.HelloProducer + "=" + *producer,
+			fmt.Sprintf("%s=%d", ingest.HelloEpoch, ulid.Now()),
+		}
+		seqr = &sequencer{}
+	}
+	compressHello, ok := parseCompress(*compress)
+	if !ok {
+		return fmt.Errorf("-compress %q unsupported, must be snappy", *compress)
+	}
+	if *compressFlush <= 0 {
+		return errors.New("-compress.flush must be positive")
+	}
+	hello = append(hello, compressHello...)
+
+	// Pick a topic for each record, by the routing rules.
+	var rt *router
+	if *routeFile != "" {
+		var err error
+		if rt, err = loadRouter(*routeFile); err != nil {
+			return errors.Wrap(err, "loading -route.file")
+		}
+	}
+
+	// Redact sensitive data from records, before they're routed.
+	var redactor *record.Redactor
+	if *redactFile != "" {
+		var err error
+		if redactor, err = loadRedactor(*redactFile, redactions); err != nil {
+			return errors.Wrap(err, "loading -redact.file")
+		}
+	}
+
+	// Label records as they're read: redact them, and prepend the prefix of
+	// the file they're read from, or else the topic they're routed to, and
+	// then the prefix expression. Tag them as they're forwarded.
+	label := func(filePrefix string, rec []byte) []byte {
+		if redactor != nil {
+			rec = redactor.Redact(rec)
+		}
+		if rt != nil {
+			topic := rt.route(rec)
+			routedRecords.WithLabelValues(topic).Inc()
+			filePrefix = topic + " "
+		}
+		labeled := make([]byte, 0, len(filePrefix)+len(prefix)+len(rec))
+		return append(append(append(labeled, filePrefix...), prefix...), rec...)
+	}
+	format := func(rec []byte) string {
+		if seqr != nil {
+			return seqr.tag(string(rec))
+		}
+		return string(rec)
+	}
+
 	// Shuffle the order.
 	rand.Seed(time.Now().UnixNano())
 	for i := range urls {
@@ -124,16 +339,147 @@ func runForward(args []string) error {
 		urls[i], urls[j] = urls[j], urls[i]
 	}
 
-	// Build a scanner for the input, and the last record we scanned.
+	// Build a reader for the input records, which may span several lines.
+	// Long lines are split, as they are when tailing files.
+	rfac := record.LimitReaderFactory(record.NewLineReader, defaultIngestRecordMaxSize, record.OversizeSplit, false, splitRecords)
+	if len(mlStart) > 0 {
+		start, err := compileRegexps(mlStart)
+		if err != nil {
+			return errors.Wrap(err, "parsing -multiline.start")
+		}
+		rfac = record.MultilineReaderFactory(rfac, start, false, *mlTimeout, *mlMaxSize)
+	}
+
+	// Build a reader for the input, and the last record we read.
 	// These both outlive any individual connection to an ingester.
-	// TODO(pb): have flag for backpressure vs. drop
+	// Records are committed once they're forwarded, so files are tailed
+	// from there after a restart.
 	var (
-		s       = bufio.NewScanner(os.Stdin)
-		backoff = time.Duration(0)
+		stdin = rfac(os.Stdin)
+		read  = func() ([]byte, error) {
+			rec, err := stdin()
+			if err != nil {
+				return nil, err
+			}
+			return label("", rec), nil
+		}
+		commit    = func(n int) {}
+		inputName = "stdin"
+		backoff   = time.Duration(0)
+		window    *ackWindow
 	)
+	if len(files) > 0 {
+		// Tail files instead. Checkpoints are saved when we're interrupted;
+		// interrupt us again to exit without waiting to forward the rest.
+		if len(mlStart) > 0 {
+			return errors.New("-multiline.start isn't supported with -file")
+		}
+		var inputs []fileInput
+		for _, s := range files {
+			in, err := parseFileInput(s)
+			if err != nil {
+				return err
+			}
+			if in.prefix != "" && rt != nil {
+				return fmt.Errorf("-file %q has a prefix, which -route.file would follow with a topic; use one or the other", s)
+			}
+			inputs = append(inputs, in)
+		}
+		t, err := newTailer(inputs, *fileCkpt, *filePoll, defaultIngestRecordMaxSize, label, logger)
+		if err != nil {
+			return errors.Wrap(err, "tailing files")
+		}
+		defer func() {
+			if err := t.save(true); err != nil { // what's committed since it stopped
+				level.Error(logger).Log("checkpoints", *fileCkpt, "err", err)
+			}
+		}()
+		go func() {
+			c := make(chan os.Signal, 1)
+			signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+			sig := <-c
+			signal.Stop(c)
+			level.Info(logger).Log("signal", sig, "tail", "stopping")
+			if err := t.close(); err != nil {
+				level.Error(logger).Log("checkpoints", *fileCkpt, "err", err)
+			}
+		}()
+		read, commit, inputName = t.read, t.commit, "files"
+	}
+
+	// Keep reading the input into a spool, on disk or in memory, and forward
+	// from there.
+	summary := func(n int) []byte { return label("", dropSummary(n)) }
+	var sp *spool
+	switch {
+	case *spoolDir != "" && *ringSize > 0:
+		return errors.New("-spool.dir and -ring.size are mutually exclusive")
+	case *ringSize < 0:
+		return errors.New("-ring.size must not be negative")
+	case *ringSize > 0:
+		sp = newMemorySpool(*ringSize, summary, spoolRecords, spoolBytes, spoolDropped)
+	case *spoolDir != "":
+		policy, err := parseSpoolOverflow(*spoolPolicy)
+		if err != nil {
+			return err
+		}
+		if *spoolMaxSize <= 0 {
+			return errors.New("-spool.max-size must be positive")
+		}
+		if sp, err = newSpool(*spoolDir, *spoolMaxSize, policy, summary, spoolRecords, spoolBytes, spoolDropped); err != nil {
+			return errors.Wrap(err, "opening spool")
+		}
+		level.Info(logger).Log("spool", *spoolDir, "records", sp.records, "bytes", sp.bytes, "overflow", policy)
+	}
+	if sp != nil {
+		// Once spooled, records are forwarded, and released from the spool
+		// once they're committed.
+		go sp.fill(read, commit)
+		read, commit = sp.read, sp.commit
+	}
+	if *ack {
+		if *ackWindowSize <= 0 {
+			return errors.New("-ack.window must be positive")
+		}
+		window = newAckWindow(*ackWindowSize, commit)
+	}
+	unsent := &unsentRecords{commit: commit}
+	var batches *batcher
+	if *bulk {
+		if *ack {
+			return errors.New("-ack and -bulk are mutually exclusive; batches are always acked")
+		}
+		if *bulkMaxSize <= 0 || *bulkMaxSize > ingest.BulkMaxSize {
+			return fmt.Errorf("-bulk.max-size must be positive, and at most %d", ingest.BulkMaxSize)
+		}
+		batches = newBatcher(read, format, *bulkMaxSize, *bulkMaxAge)
+	}
 
 	// Enter the connect and forward loop. We do this forever.
 	for ; ; urls = append(urls[1:], urls[0]) { // rotate thru URLs
+		// In bulk mode, each batch gets its own connection, once it's ready.
+		// It goes to the next ingester, after a failure or not.
+		var batch []string
+		if batches != nil {
+			var ok bool
+			if batch, ok = batches.next(); !ok {
+				level.Info(logger).Log(inputName, "exhausted", "due_to", batches.err)
+				return nil
+			}
+		}
+
+		// With discovery, there's just one, picked from the live ingesters.
+		for peer != nil {
+			addr, ok := pickIngester(peer.Ingesters(), ingestPort, defaultPort)
+			if ok {
+				urls = []*url.URL{{Scheme: "tcp", Host: addr}}
+				break
+			}
+			level.Warn(logger).Log("cluster", "no ingesters available")
+			backoff = exponential(backoff)
+			time.Sleep(backoff)
+		}
+
 		// We gonna try to connect to this first one.
 		target := urls[0]
 
@@ -187,7 +533,7 @@ func runForward(args []string) error {
 		}
 		level.Debug(logger).Log("raw_target", urls[0].String(), "resolved_target", target.String())
 
-		conn, err := net.Dial(target.Scheme, target.Host)
+		conn, err := dial(target.Scheme, target.Host)
 		if err != nil {
 			level.Warn(logger).Log("Dial", target.String(), "err", err)
 			backoff = exponential(backoff)
@@ -195,31 +541,433 @@ func runForward(args []string) error {
 			continue
 		}
 
-		ok := s.Scan()
-		for ok {
-			// We enter the loop wanting to write s.Text() to the conn.
-			record := fmt.Sprintf("%s%s\n", prefix, s.Text())
-			if n, err := fmt.Fprintf(conn, record); err != nil {
+		if batches != nil {
+			err := forwardBulk(conn, batch, hello, *compressFlush)
+			conn.Close()
+			if err != nil {
 				disconnects.Inc()
 				level.Warn(logger).Log("disconnected_from", target.String(), "due_to", err)
-				break
-			} else if n < len(record) {
-				shortWrites.Inc()
-				level.Warn(logger).Log("short_write_to", target.String(), "n", n, "less_than", len(record))
-				break // TODO(pb): we should do something more sophisticated here
+				backoff = exponential(backoff)
+				time.Sleep(backoff)
+				continue
+			}
+			batches.done()
+			commit(len(batch))
+			backoff = 0
+			for _, record := range batch {
+				forwardBytes.Add(float64(len(record)))
 			}
+			forwardRecords.Add(float64(len(batch)))
+			continue
+		}
 
-			// Only once the write succeeds do we scan the next record.
-			backoff = 0 // reset the backoff on a successful write
-			forwardBytes.Add(float64(len(record)))
-			forwardRecords.Inc()
-			ok = s.Scan()
+		if window != nil {
+			// With acks, records stay in the window until the ingester has
+			// persisted them, and survive to be resent on the next connection.
+			exhausted, err := forwardAcked(conn, read, format, hello, *compressFlush, window, forwardBytes, forwardRecords, resentRecords)
+			conn.Close()
+			if exhausted {
+				level.Info(logger).Log(inputName, "exhausted", "due_to", err)
+				return nil
+			}
+			disconnects.Inc()
+			level.Warn(logger).Log("disconnected_from", target.String(), "due_to", err)
+			backoff = exponential(backoff)
+			time.Sleep(backoff)
+			continue
 		}
-		if !ok {
-			level.Info(logger).Log("stdin", "exhausted", "due_to", s.Err())
+
+		// Without acks, records stay unsent until they're written through to
+		// the conn, and survive to be resent on the next connection.
+		written, exhausted, err := forwardFast(conn, read, format, hello, *compressFlush, unsent, forwardBytes, forwardRecords, resentRecords)
+		conn.Close()
+		if exhausted {
+			level.Info(logger).Log(inputName, "exhausted", "due_to", err)
 			return nil
 		}
+		if written > 0 {
+			backoff = 0 // reset the backoff after successful writes
+		}
+		if err == io.ErrShortWrite {
+			shortWrites.Inc()
+		}
+		disconnects.Inc()
+		level.Warn(logger).Log("disconnected_from", target.String(), "due_to", err)
+		backoff = exponential(backoff)
+		time.Sleep(backoff)
+	}
+}
+
+// forwardFast writes records from read, formatted by format, to w, with the
+// hello options. Records unsent from previous connections are resent first.
+// It returns the number of records written, and true, with the read error,
+// once read is exhausted and every record is written through.
+func forwardFast(
+	w io.Writer,
+	read record.Reader,
+	format func([]byte) string,
+	hello []string,
+	flush time.Duration,
+	unsent *unsentRecords,
+	forwardBytes, forwardRecords, resentRecords prometheus.Counter,
+) (written int, exhausted bool, err error) {
+	rw, err := openRecords(w, hello, flush, unsent.written)
+	if err != nil {
+		return 0, false, err
+	}
+	write := func(record string) error {
+		n, err := io.WriteString(rw, record)
+		if err == nil && n < len(record) {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			rw.Close()
+		}
+		return err
+	}
+	for _, record := range unsent.begin() {
+		if err := write(record); err != nil {
+			return written, false, err
+		}
+		written++
+		resentRecords.Inc()
+	}
+	for {
+		rec, readErr := read()
+		if readErr != nil {
+			if err := rw.Close(); err != nil { // flush what's compressed
+				return written, false, err
+			}
+			return written, true, readErr
+		}
+		record := format(rec)
+		unsent.push(record)
+		if err := write(record); err != nil {
+			return written, false, err
+		}
+		written++
+		forwardBytes.Add(float64(len(record)))
+		forwardRecords.Inc()
+	}
+}
+
+// unsentRecords holds records written to a connection, but not yet written
+// through it, e.g. while they're compressed, in the order they were written.
+// They're committed once they're written through, and otherwise resent on
+// the next connection.
+type unsentRecords struct {
+	mtx     sync.Mutex
+	records []string
+	commit  func(n int)
+}
+
+// begin returns the records to resend on a new connection.
+func (u *unsentRecords) begin() []string {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	return append([]string{}, u.records...)
+}
+
+func (u *unsentRecords) push(record string) {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	u.records = append(u.records, record)
+}
+
+// written commits the oldest n records, once they're written through.
+func (u *unsentRecords) written(n int) {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	if n > len(u.records) {
+		n = len(u.records)
+	}
+	u.records = u.records[n:]
+	u.commit(n)
+}
+
+// forwardAcked writes records from read, formatted by format, to conn,
+// requesting an ack for each one, along with the other hello options.
+// Records unacked from previous connections are resent first. It returns
+// true, with the read error, once read is exhausted and every record has been
+// acked.
+func forwardAcked(
+	conn net.Conn,
+	read record.Reader,
+	format func([]byte) string,
+	hello []string,
+	flush time.Duration,
+	window *ackWindow,
+	forwardBytes, forwardRecords, resentRecords prometheus.Counter,
+) (exhausted bool, err error) {
+	w, err := openRecords(conn, append([]string{ingest.HelloAck}, hello...), flush, nil)
+	if err != nil {
+		return false, err
+	}
+	defer w.Close()
+	gen, resend := window.begin()
+	go window.readAcks(gen, conn)
+
+	for _, record := range resend {
+		if _, err := io.WriteString(w, record); err != nil {
+			return false, err
+		}
+		resentRecords.Inc()
+	}
+	for {
+		rec, readErr := read()
+		if readErr != nil {
+			if err := window.drain(); err != nil {
+				return false, err
+			}
+			return true, readErr
+		}
+		record := format(rec)
+		if err := window.push(record); err != nil {
+			return false, err
+		}
+		if _, err := io.WriteString(w, record); err != nil {
+			return false, err
+		}
+		forwardBytes.Add(float64(len(record)))
+		forwardRecords.Inc()
+	}
+}
+
+// forwardBulk writes a batch of records to conn, for an ingester's bulk
+// writer, and closes our side of the connection, so the ingester writes the
+// batch. It returns once the batch is acked, as a whole: the ingester may
+// drop or join records, so the count it acks with needn't match ours.
+func forwardBulk(conn net.Conn, batch []string, hello []string, flush time.Duration) error {
+	cw, ok := conn.(interface{ CloseWrite() error })
+	if !ok {
+		return errors.New("connection can't be half-closed")
+	}
+	bw := bufio.NewWriterSize(conn, 64*1024)
+	w, err := openRecords(bw, append([]string{ingest.HelloAck}, hello...), flush, nil)
+	if err != nil {
+		return err
+	}
+	for _, record := range batch {
+		if _, err := io.WriteString(w, record); err != nil {
+			w.Close()
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if err := cw.CloseWrite(); err != nil {
+		return err
+	}
+	s := bufio.NewScanner(conn)
+	if !s.Scan() {
+		err := s.Err()
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return errors.Wrapf(err, "batch of %d records not acked", len(batch))
+	}
+	if _, err := strconv.Atoi(s.Text()); err != nil {
+		return errors.Errorf("batch of %d records acked with %q", len(batch), s.Text())
+	}
+	return nil
+}
+
+// batcher groups formatted records into batches, each shipped once it would
+// grow past a maximum size, as written by the ingester, or once its first
+// record reaches a maximum age. A batch that fails to ship is retried.
+type batcher struct {
+	batches chan []string
+	pending []string
+	err     error // from the input, once batches is closed
+}
+
+// bulkRecordOverhead is the size of the ID an ingester adds to each record.
+const bulkRecordOverhead = ulid.EncodedSize + 1
+
+func newBatcher(read record.Reader, format func([]byte) string, maxSize int, maxAge time.Duration) *batcher {
+	b := &batcher{batches: make(chan []string)}
+	records := make(chan string)
+	go func() {
+		defer close(records)
+		for {
+			rec, err := read()
+			if err != nil {
+				b.err = err
+				return
+			}
+			records <- format(rec)
+		}
+	}()
+	go b.run(records, maxSize, maxAge)
+	return b
+}
+
+func (b *batcher) run(records <-chan string, maxSize int, maxAge time.Duration) {
+	defer close(b.batches)
+	var (
+		batch []string
+		size  int
+		timer *time.Timer
+		ship  <-chan time.Time
+	)
+	flush := func() {
+		b.batches <- batch
+		batch, size = nil, 0
+		timer.Stop()
+		ship = nil
+	}
+	for {
+		select {
+		case record, ok := <-records:
+			if !ok {
+				if len(batch) > 0 {
+					flush()
+				}
+				return
+			}
+			sz := len(record) + bulkRecordOverhead
+			if len(batch) > 0 && size+sz > maxSize {
+				flush()
+			}
+			if len(batch) <= 0 {
+				timer = time.NewTimer(maxAge)
+				ship = timer.C
+			}
+			batch = append(batch, record)
+			size += sz
+
+		case <-ship:
+			flush()
+		}
+	}
+}
+
+// next returns the batch to ship, which is the last one until it's done.
+// It returns false once the input is exhausted.
+func (b *batcher) next() ([]string, bool) {
+	if b.pending == nil {
+		batch, ok := <-b.batches
+		if !ok {
+			return nil, false
+		}
+		b.pending = batch
+	}
+	return b.pending, true
+}
+
+// done marks the batch from next as shipped.
+func (b *batcher) done() {
+	b.pending = nil
+}
+
+// ackWindow holds records written to an ingester but not yet acked, in the
+// order they were written. Each connection is a new generation; acks read from
+// an old connection are ignored, because its records are resent anyway.
+type ackWindow struct {
+	mtx     sync.Mutex
+	cond    *sync.Cond
+	records []string
+	max     int
+	gen     int
+	err     error
+	acked   func(n int)
+}
+
+// newAckWindow returns a window of at most max records, which calls acked
+// as they're acked.
+func newAckWindow(max int, acked func(n int)) *ackWindow {
+	w := &ackWindow{max: max, acked: acked}
+	w.cond = sync.NewCond(&w.mtx)
+	return w
+}
+
+// begin starts a new generation, and returns the records to resend.
+func (w *ackWindow) begin() (gen int, resend []string) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	w.gen++
+	w.err = nil
+	return w.gen, append([]string{}, w.records...)
+}
+
+// readAcks consumes one ack per line from r, until r fails.
+func (w *ackWindow) readAcks(gen int, r io.Reader) {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		w.ack(gen)
+	}
+	err := s.Err()
+	if err == nil {
+		err = io.EOF
+	}
+	w.fail(gen, err)
+}
+
+func (w *ackWindow) ack(gen int) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if gen != w.gen || len(w.records) <= 0 {
+		return
+	}
+	w.records = w.records[1:]
+	w.acked(1)
+	w.cond.Broadcast()
+}
+
+func (w *ackWindow) fail(gen int, err error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if gen != w.gen || w.err != nil {
+		return
+	}
+	w.err = err
+	w.cond.Broadcast()
+}
+
+// push adds a record to the window, blocking while the window is full.
+// If the connection has failed, the record is kept for the next connection,
+// and the error is returned.
+func (w *ackWindow) push(record string) error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	for len(w.records) >= w.max && w.err == nil {
+		w.cond.Wait()
+	}
+	w.records = append(w.records, record)
+	return w.err
+}
+
+// drain blocks until every record is acked, or the connection fails.
+func (w *ackWindow) drain() error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	for len(w.records) > 0 && w.err == nil {
+		w.cond.Wait()
+	}
+	return w.err
+}
+
+// dropSummary is the record in place of n records dropped from a spool.
+func dropSummary(n int) []byte {
+	return []byte(fmt.Sprintf("dropped %d records\n", n))
+}
+
+// sequencer tags records with a sequence number, and the time they were read,
+// which never goes backwards, as ingesters expect from producers.
+type sequencer struct {
+	seq, ms uint64
+}
+
+func (s *sequencer) tag(record string) string {
+	if ms := ulid.Now(); ms > s.ms {
+		s.ms = ms
 	}
+	s.seq++
+	return strconv.FormatUint(s.seq, 10) + ":" + strconv.FormatUint(s.ms, 10) + " " + record
 }
 
 func exponential(d time.Duration) time.Duration {
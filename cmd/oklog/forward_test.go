@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/oklog/oklog/pkg/ingest"
+)
+
+func TestBatcher(t *testing.T) {
+	records := make(chan []byte)
+	read := func() ([]byte, error) {
+		rec, ok := <-records
+		if !ok {
+			return nil, io.EOF
+		}
+		return rec, nil
+	}
+	format := func(rec []byte) string { return "p " + string(rec) }
+	b := newBatcher(read, format, 3*(len("p a\n")+bulkRecordOverhead), 50*time.Millisecond)
+
+	// Batches are shipped before they'd grow too big, and once they're old
+	// enough.
+	for _, rec := range []string{"a\n", "b\n", "c\n", "d\n"} {
+		records <- []byte(rec)
+	}
+	for _, want := range [][]string{
+		{"p a\n", "p b\n", "p c\n"},
+		{"p d\n"},
+	} {
+		have, ok := b.next()
+		if !ok {
+			t.Fatal("input exhausted early")
+		}
+		if !reflect.DeepEqual(want, have) {
+			t.Errorf("want %q, have %q", want, have)
+		}
+		if again, _ := b.next(); !reflect.DeepEqual(have, again) {
+			t.Errorf("batch not retried: want %q, have %q", have, again)
+		}
+		b.done()
+	}
+
+	// The last batch is shipped once the input is exhausted.
+	records <- []byte("e\n")
+	close(records)
+	if have, ok := b.next(); !ok || !reflect.DeepEqual([]string{"p e\n"}, have) {
+		t.Errorf("want the last batch, have %q", have)
+	}
+	b.done()
+	if _, ok := b.next(); ok {
+		t.Error("want input exhausted")
+	}
+	if b.err != io.EOF {
+		t.Errorf("want %v, have %v", io.EOF, b.err)
+	}
+}
+
+func TestForwardFast(t *testing.T) {
+	for _, testcase := range []struct {
+		name   string
+		hello  []string
+		writes int // before the first connection fails, including the hello
+		sent   int // records committed on the first connection
+	}{
+		{"plain", nil, 1, 1},
+		{"compressed", []string{ingest.HelloCompress + "=" + ingest.CompressSnappy}, 2, 0}, // the flush fails
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			records := []string{"a\n", "b\n", "c\n"}
+			read := func() ([]byte, error) {
+				if len(records) <= 0 {
+					return nil, io.EOF
+				}
+				rec := records[0]
+				records = records[1:]
+				return []byte(rec), nil
+			}
+			var (
+				committed int
+				unsent    = &unsentRecords{commit: func(n int) { committed += n }}
+				format    = func(rec []byte) string { return string(rec) }
+				counter   = func() prometheus.Counter { return prometheus.NewCounter(prometheus.CounterOpts{}) }
+			)
+
+			// Records aren't committed until they're written through.
+			_, exhausted, err := forwardFast(&failingWriter{n: testcase.writes}, read, format, testcase.hello, time.Hour, unsent, counter(), counter(), counter())
+			if exhausted || err == nil {
+				t.Fatalf("want the connection to fail, have exhausted %v, %v", exhausted, err)
+			}
+			if want, have := testcase.sent, committed; want != have {
+				t.Fatalf("after the failed connection: want %d committed, have %d", want, have)
+			}
+
+			// The rest are resent first on the next connection.
+			var buf bytes.Buffer
+			_, exhausted, err = forwardFast(&buf, read, format, testcase.hello, time.Hour, unsent, counter(), counter(), counter())
+			if !exhausted || err != io.EOF {
+				t.Fatalf("want exhausted with %v, have %v, %v", io.EOF, exhausted, err)
+			}
+			if want, have := 3, committed; want != have {
+				t.Errorf("want %d committed, have %d", want, have)
+			}
+			var r io.Reader = &buf
+			if testcase.hello != nil {
+				br := bufio.NewReader(&buf)
+				br.ReadString('\n') // the hello
+				r = snappy.NewReader(br)
+			}
+			have, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := "abc"[testcase.sent:]; want != string(bytes.ReplaceAll(have, []byte("\n"), nil)) {
+				t.Errorf("want %q resent and forwarded, have %q", want, have)
+			}
+		})
+	}
+}
+
+// failingWriter fails every write after the first n.
+type failingWriter struct{ n int }
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.n <= 0 {
+		return 0, errors.New("connection failed")
+	}
+	w.n--
+	return len(p), nil
+}
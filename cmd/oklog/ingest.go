@@ -1,12 +1,15 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"time"
 
@@ -30,6 +33,16 @@ const (
 	defaultIngestSegmentFlushSize      = 16 * 1024 * 1024
 	defaultIngestSegmentFlushAge       = 3 * time.Second
 	defaultIngestSegmentPendingTimeout = time.Minute
+	defaultIngestLoadReportInterval    = 5 * time.Second
+	defaultIngestShedMinConnections    = 10
+	defaultIngestRecordMaxSize         = 1024 * 1024
+	defaultIngestTimestampMaxPast      = 7 * 24 * time.Hour
+	defaultIngestTimestampMaxFuture    = 5 * time.Minute
+	defaultMultilineTimeout            = time.Second
+	defaultIngestDiskCheckInterval     = time.Second
+	defaultIngestDrainReportInterval   = 5 * time.Second
+	defaultIngestDedupWindow           = 10 * time.Minute
+	defaultIngestCorruptRetention      = 7 * 24 * time.Hour
 )
 
 const (
@@ -37,6 +50,21 @@ const (
 	topicModeDynamic = "dynamic"
 )
 
+const (
+	timestampArrival = "arrival"
+	timestampRFC3339 = "rfc3339"
+	timestampLogfmt  = "logfmt"
+	timestampJSON    = "json"
+	timestampAny     = "any"
+)
+
+const (
+	defaultSyslogPort   = 514
+	defaultSyslogTopic  = "syslog"
+	syslogTopicAppName  = "app-name"
+	syslogTopicFacility = "facility"
+)
+
 var (
 	defaultFastAddr    = fmt.Sprintf("tcp://0.0.0.0:%d", defaultFastPort)
 	defaultDurableAddr = fmt.Sprintf("tcp://0.0.0.0:%d", defaultDurablePort)
@@ -54,16 +82,45 @@ func runIngest(args []string) error {
 		fastAddr              = flagset.String("ingest.fast", defaultFastAddr, "listen address for fast (async) writes")
 		durableAddr           = flagset.String("ingest.durable", defaultDurableAddr, "listen address for durable (sync) writes")
 		bulkAddr              = flagset.String("ingest.bulk", defaultBulkAddr, "listen address for bulk (whole-segment) writes")
+		tlsCert               = flagset.String("ingest.tls-cert", "", "optional, TLS certificate file for the fast, durable and bulk listeners")
+		tlsKey                = flagset.String("ingest.tls-key", "", "optional, TLS key file for the fast, durable and bulk listeners")
+		tlsClientCA           = flagset.String("ingest.tls-client-ca", "", "optional, CA bundle to verify client certificates (requires -ingest.tls-cert)")
+		syslogUDPAddr         = flagset.String("ingest.syslog-udp", "", "optional, listen address for syslog over UDP")
+		syslogTCPAddr         = flagset.String("ingest.syslog-tcp", "", "optional, listen address for syslog over TCP")
+		syslogTopic           = flagset.String("ingest.syslog-topic", syslogTopicAppName, "topic for syslog messages (app-name, facility)")
 		clusterBindAddr       = flagset.String("cluster", defaultClusterAddr, "listen address for cluster")
 		clusterAdvertiseAddr  = flagset.String("cluster.advertise-addr", "", "optional, explicit address to advertise in cluster")
 		ingestPath            = flagset.String("ingest.path", defaultIngestPath, "path holding segment files for ingest tier")
 		segmentFlushSize      = flagset.Int("ingest.segment-flush-size", defaultIngestSegmentFlushSize, "flush segments after they grow to this size")
 		segmentFlushAge       = flagset.Duration("ingest.segment-flush-age", defaultIngestSegmentFlushAge, "flush segments after they are active for this long")
+		segmentPerTopic       = flagset.Bool("ingest.segment-per-topic", false, "write each topic to its own segments, so consumers may request them by topic (up to 64 open per connection; further topics share one)")
 		segmentPendingTimeout = flagset.Duration("ingest.segment-pending-timeout", defaultIngestSegmentPendingTimeout, "claimed but uncommitted pending segments are failed after this long")
+		corruptRetention      = flagset.Duration("ingest.corrupt-retention", defaultIngestCorruptRetention, "segments quarantined as damaged during recovery are removed after this long (0 keeps them)")
+		dedupWindow           = flagset.Duration("ingest.dedup-window", defaultIngestDedupWindow, "drop records redelivered by a producer within this long of its last record (0 disables)")
+		shedFactor            = flagset.Float64("ingest.shed-factor", 0, "refuse connections when load exceeds this multiple of the cluster mean (0 disables)")
+		shedMinConnections    = flagset.Int("ingest.shed-min-connections", defaultIngestShedMinConnections, "never refuse connections with fewer than this many connected")
+		connRateLimit         = flagset.Float64("ingest.rate-limit-connection", 0, "maximum records per second per connection (0 is unlimited)")
+		connRateBurst         = flagset.Int("ingest.rate-limit-connection-burst", 0, "records allowed in a burst per connection (0 is one second's worth)")
+		connRatePolicy        = flagset.String("ingest.rate-limit-connection-policy", string(ingest.RateLimitBlock), "records over the connection limit: block, drop, disconnect")
+		topicRateLimit        = flagset.Float64("ingest.rate-limit-topic", 0, "maximum records per second per topic (0 is unlimited)")
+		topicRateBurst        = flagset.Int("ingest.rate-limit-topic-burst", 0, "records allowed in a burst per topic (0 is one second's worth)")
+		topicRatePolicy       = flagset.String("ingest.rate-limit-topic-policy", string(ingest.RateLimitBlock), "records over the topic limit: block, drop, disconnect")
+		recordMaxSize         = flagset.Int("ingest.record-max-size", defaultIngestRecordMaxSize, "maximum record size in bytes, excluding the newline (0 is unlimited)")
+		recordMaxPolicy       = flagset.String("ingest.record-max-policy", string(record.OversizeTruncate), "records over the maximum size: truncate, split (refuses clients using -producer, or acks but for bulk writes), reject")
+		timestampMode         = flagset.String("ingest.timestamp", timestampArrival, "time for record IDs: arrival, or the event time from rfc3339 prefix, logfmt ts, json time, any")
+		timestampMaxPast      = flagset.Duration("ingest.timestamp-max-past", defaultIngestTimestampMaxPast, "clamp event times further in the past than this (0 is unlimited)")
+		timestampMaxFuture    = flagset.Duration("ingest.timestamp-max-future", defaultIngestTimestampMaxFuture, "clamp event times further in the future than this (0 is unlimited)")
+		multilineTimeout      = flagset.Duration("ingest.multiline-timeout", defaultMultilineTimeout, "emit a multiline record after no more lines for this long")
+		diskHighWatermark     = flagset.Int64("ingest.disk-high-watermark", 0, "stop taking records once segments total this many bytes (0 disables)")
+		diskLowWatermark      = flagset.Int64("ingest.disk-low-watermark", 0, "resume taking records once segments total this many bytes (0 is 90% of high)")
+		diskFullPolicy        = flagset.String("ingest.disk-full-policy", string(ingest.DiskFullBlock), "above the high watermark: block reads, or also refuse new connections")
+		redactFile            = flagset.String("ingest.redact-file", "", "optional, file of rules masking or hashing sensitive data, e.g. card numbers, in records before they're written")
 		filesystem            = flagset.String("filesystem", defaultFilesystem, "real, virtual, nop")
 		clusterPeers          = stringslice{}
+		multilineStart        = stringslice{}
 	)
 	flagset.Var(&clusterPeers, "peer", "cluster peer host:port (repeatable)")
+	flagset.Var(&multilineStart, "ingest.multiline-start", "optional, regexp matching the first line of a record; other lines are joined onto the record before them (repeatable; refuses clients using -producer, or acks but for bulk writes)")
 	flagset.Usage = usageFor(flagset, "oklog ingest [flags]")
 	if err := flagset.Parse(args); err != nil {
 		return err
@@ -148,6 +205,76 @@ func runIngest(args []string) error {
 		Name:      "ingest_committed_bytes",
 		Help:      "Bytes successfully consumed and committed.",
 	})
+	rateLimitDropped := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "oklog",
+		Name:      "ingest_rate_limit_dropped_records_total",
+		Help:      "Records dropped or disconnected for exceeding a rate limit, by limit.",
+	}, []string{"limit"})
+	rateLimitThrottled := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "oklog",
+		Name:      "ingest_rate_limit_throttled_records_total",
+		Help:      "Records delayed to stay within a rate limit, by limit.",
+	}, []string{"limit"})
+	oversizedRecords := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "oklog",
+		Name:      "ingest_oversized_records_total",
+		Help:      "Records over the maximum size, by how they were handled.",
+	}, []string{"policy"})
+	redactions := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "oklog",
+		Name:      "ingest_redactions_total",
+		Help:      "Sensitive values masked or hashed in records, by redaction rule.",
+	}, []string{"rule"})
+	timestampAdjusted := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "oklog",
+		Name:      "ingest_timestamp_adjusted_records_total",
+		Help:      "Records not identified by their event time as given, by reason.",
+	}, []string{"reason"})
+	corruptRecords := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "oklog",
+		Name:      "ingest_corrupt_records_total",
+		Help:      "Records in ingest segments that failed their checksum, and weren't consumed.",
+	})
+	quarantinedSegments := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "oklog",
+		Name:      "ingest_quarantined_segments_total",
+		Help:      "Damaged ingest segments found during recovery, and set aside.",
+	})
+	logBytes := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "oklog",
+		Name:      "ingest_log_bytes",
+		Help:      "Total size of active, flushed, pending, and quarantined segments.",
+	})
+	diskFullGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "oklog",
+		Name:      "ingest_disk_full",
+		Help:      "1 if the ingest log is over the high watermark, 0 otherwise.",
+	})
+	diskFullConnections := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "oklog",
+		Name:      "ingest_disk_full_refused_connections_total",
+		Help:      "Connections refused while the ingest log is over the high watermark.",
+	})
+	diskFullPackets := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "oklog",
+		Name:      "ingest_disk_full_dropped_packets_total",
+		Help:      "Syslog packets dropped while the ingest log is over the high watermark.",
+	})
+	duplicateRecords := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "oklog",
+		Name:      "ingest_duplicate_records_total",
+		Help:      "Records redelivered by producers, and dropped as duplicates.",
+	})
+	sheddingGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "oklog",
+		Name:      "ingest_shedding",
+		Help:      "1 if this ingester refuses new connections due to load, 0 otherwise.",
+	})
+	shedConnections := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "oklog",
+		Name:      "ingest_shed_connections_total",
+		Help:      "Connections refused due to load.",
+	})
 	apiDuration := prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Namespace: "oklog",
 		Name:      "api_request_duration_seconds",
@@ -165,6 +292,20 @@ func runIngest(args []string) error {
 		failedSegments,
 		committedSegments,
 		committedBytes,
+		rateLimitDropped,
+		rateLimitThrottled,
+		oversizedRecords,
+		redactions,
+		timestampAdjusted,
+		corruptRecords,
+		quarantinedSegments,
+		logBytes,
+		diskFullGauge,
+		diskFullConnections,
+		diskFullPackets,
+		duplicateRecords,
+		sheddingGauge,
+		shedConnections,
 		apiDuration,
 	)
 
@@ -241,6 +382,46 @@ func runIngest(args []string) error {
 	}
 	level.Info(logger).Log("API", fmt.Sprintf("%s://%s", apiNetwork, apiAddress))
 
+	// Optionally bind syslog listeners.
+	var (
+		syslogPacketConn net.PacketConn
+		syslogListener   net.Listener
+	)
+	if *syslogUDPAddr != "" {
+		_, syslogUDPAddress, _, _, err := parseAddr(*syslogUDPAddr, defaultSyslogPort)
+		if err != nil {
+			return err
+		}
+		syslogPacketConn, err = net.ListenPacket("udp", syslogUDPAddress)
+		if err != nil {
+			return err
+		}
+		level.Info(logger).Log("syslog", fmt.Sprintf("udp://%s", syslogUDPAddress))
+	}
+	if *syslogTCPAddr != "" {
+		syslogTCPNetwork, syslogTCPAddress, _, _, err := parseAddr(*syslogTCPAddr, defaultSyslogPort)
+		if err != nil {
+			return err
+		}
+		syslogListener, err = net.Listen(syslogTCPNetwork, syslogTCPAddress)
+		if err != nil {
+			return err
+		}
+		level.Info(logger).Log("syslog", fmt.Sprintf("%s://%s", syslogTCPNetwork, syslogTCPAddress))
+	}
+
+	// Optionally wrap the ingest listeners with TLS.
+	tlsConfig, err := newServerTLSConfig(*tlsCert, *tlsKey, *tlsClientCA)
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		fastListener = tls.NewListener(fastListener, tlsConfig)
+		durableListener = tls.NewListener(durableListener, tlsConfig)
+		bulkListener = tls.NewListener(bulkListener, tlsConfig)
+		level.Info(logger).Log("ingest_tls", true, "client_auth", tlsConfig.ClientAuth == tls.RequireAndVerifyClientCert)
+	}
+
 	// Create ingest log.
 	var fsys fs.Filesystem
 	switch strings.ToLower(*filesystem) {
@@ -254,7 +435,7 @@ func runIngest(args []string) error {
 		return errors.Errorf("invalid -filesystem %q", *filesystem)
 	}
 
-	ingestLog, err := ingest.NewFileLog(fsys, *ingestPath)
+	ingestLog, err := ingest.NewFileLog(fsys, *ingestPath, *corruptRetention, corruptRecords, quarantinedSegments)
 	if err != nil {
 		return err
 	}
@@ -283,6 +464,61 @@ func runIngest(args []string) error {
 		Help:      "Number of peers in the cluster from this node's perspective.",
 	}, func() float64 { return float64(peer.ClusterSize()) }))
 
+	// Advertise our listeners, for forwarders discovering ingesters.
+	peer.SetIngestPorts(cluster.IngestPorts{
+		Fast:    listenerPort(fastListener),
+		Durable: listenerPort(durableListener),
+		Bulk:    listenerPort(bulkListener),
+	})
+
+	// Track active connections, for the API, and drain on request: refuse new
+	// connections, and disconnect active ones, until the log is empty.
+	conns := ingest.NewConnections()
+	drainer := ingest.NewDrainer(ingestLog, conns)
+	fastListener = drainer.Listener(fastListener)
+	durableListener = drainer.Listener(durableListener)
+	bulkListener = drainer.Listener(bulkListener)
+	if syslogListener != nil {
+		syslogListener = drainer.Listener(syslogListener)
+	}
+	if syslogPacketConn != nil {
+		syslogPacketConn = drainer.PacketConn(syslogPacketConn)
+	}
+
+	// Stop taking records while the ingest log is too big, e.g. because the
+	// store tier isn't consuming segments.
+	diskPolicy, err := ingest.ParseDiskFullPolicy(*diskFullPolicy)
+	if err != nil {
+		return err
+	}
+	diskMonitor := ingest.NewDiskMonitor(
+		ingestLog,
+		defaultIngestDiskCheckInterval,
+		*diskHighWatermark, *diskLowWatermark, diskPolicy,
+		logBytes, diskFullGauge, diskFullConnections,
+	)
+	fastListener = diskMonitor.Listener(fastListener)
+	durableListener = diskMonitor.Listener(durableListener)
+	bulkListener = diskMonitor.Listener(bulkListener)
+	if syslogListener != nil {
+		syslogListener = diskMonitor.Listener(syslogListener)
+	}
+	if syslogPacketConn != nil {
+		syslogPacketConn = diskMonitor.PacketConn(syslogPacketConn, diskFullPackets)
+	}
+
+	// Gossip our load, and refuse new connections while overloaded.
+	shedder := ingest.NewLoadShedder(
+		drainer.LoadPeer(diskMonitor.LoadPeer(peer)),
+		defaultIngestLoadReportInterval,
+		*shedFactor, *shedMinConnections,
+		sheddingGauge, shedConnections,
+	)
+	defer shedder.Stop()
+	fastListener = shedder.Listener(fastListener)
+	durableListener = shedder.Listener(durableListener)
+	bulkListener = shedder.Listener(bulkListener)
+
 	var rfac record.ReaderFactory
 	{
 		topicb := []byte(*topic)
@@ -298,6 +534,126 @@ func runIngest(args []string) error {
 		}
 	}
 
+	// Limit the size of records. Acks and producer sequence numbers count
+	// lines as records, so they're unsupported if lines may be split or joined.
+	var unsupportedHellos []string
+	oversizePolicy, err := record.ParseOversizePolicy(*recordMaxPolicy)
+	if err != nil {
+		return err
+	}
+	if oversizePolicy == record.OversizeSplit && *recordMaxSize > 0 {
+		unsupportedHellos = []string{ingest.HelloAck, ingest.HelloProducer}
+	}
+
+	// Join lines into multiline records, e.g. stack traces.
+	var multilineStartRegexps []*regexp.Regexp
+	if len(multilineStart) > 0 {
+		if multilineStartRegexps, err = compileRegexps(multilineStart); err != nil {
+			return errors.Wrap(err, "parsing -ingest.multiline-start")
+		}
+		unsupportedHellos = []string{ingest.HelloAck, ingest.HelloProducer}
+	}
+
+	// The bulk writer acks each batch as a whole, however many records it has.
+	var bulkUnsupportedHellos []string
+	if len(unsupportedHellos) > 0 {
+		bulkUnsupportedHellos = []string{ingest.HelloProducer}
+	}
+
+	// Redact sensitive data from records, before they're written.
+	var redactor *record.Redactor
+	if *redactFile != "" {
+		if redactor, err = loadRedactor(*redactFile, redactions); err != nil {
+			return errors.Wrap(err, "loading -ingest.redact-file")
+		}
+	}
+
+	// Limit the rate of records per connection and per topic.
+	var rateLimiter *ingest.RateLimiter
+	{
+		connPolicy, err := ingest.ParseRateLimitPolicy(*connRatePolicy)
+		if err != nil {
+			return err
+		}
+		topicPolicy, err := ingest.ParseRateLimitPolicy(*topicRatePolicy)
+		if err != nil {
+			return err
+		}
+		rateLimiter = ingest.NewRateLimiter(
+			ingest.RateLimit{Rate: *connRateLimit, Burst: *connRateBurst, Policy: connPolicy},
+			ingest.RateLimit{Rate: *topicRateLimit, Burst: *topicRateBurst, Policy: topicPolicy},
+			rateLimitDropped, rateLimitThrottled,
+		)
+	}
+
+	// Apply all of the above to records read from connections, and to records
+	// pushed with a topic parameter, which are read as if in static mode.
+	wrap := func(rfac record.ReaderFactory, dynamic bool) record.ReaderFactory {
+		rfac = record.LimitReaderFactory(rfac, *recordMaxSize, oversizePolicy, dynamic, oversizedRecords.WithLabelValues(string(oversizePolicy)))
+		if len(multilineStartRegexps) > 0 {
+			rfac = record.MultilineReaderFactory(rfac, multilineStartRegexps, true, *multilineTimeout, *recordMaxSize)
+		}
+		if redactor != nil {
+			rfac = record.RedactReaderFactory(rfac, redactor, true)
+		}
+		return diskMonitor.ReaderFactory(rateLimiter.ReaderFactory(rfac))
+	}
+	rfac = wrap(rfac, *topicMode == topicModeDynamic)
+	topicReaderFactory := func(topic []byte) record.ReaderFactory {
+		return wrap(record.StaticReaderFactory(topic), false)
+	}
+
+	// Identify records by their arrival or event time.
+	var idfac ingest.IDGeneratorFactory
+	{
+		var ts record.TimestampFunc
+		switch *timestampMode {
+		case timestampArrival:
+		case timestampRFC3339:
+			ts = record.RFC3339Timestamp
+		case timestampLogfmt:
+			ts = record.LogfmtTimestamp
+		case timestampJSON:
+			ts = record.JSONTimestamp
+		case timestampAny:
+			ts = record.AnyTimestamp
+		default:
+			return fmt.Errorf("timestamp %q invalid, must be %q, %q, %q, %q, or %q", *timestampMode, timestampArrival, timestampRFC3339, timestampLogfmt, timestampJSON, timestampAny)
+		}
+		idfac = ingest.NewIDGenerator
+		if ts != nil {
+			idfac = ingest.EventTimeIDGenerators(ts, *timestampMaxPast, *timestampMaxFuture, timestampAdjusted)
+		}
+	}
+
+	var syslogTopicFunc record.SyslogTopicFunc
+	switch *syslogTopic {
+	case syslogTopicAppName:
+		syslogTopicFunc = record.SyslogAppNameTopic([]byte(defaultSyslogTopic))
+	case syslogTopicFacility:
+		syslogTopicFunc = record.SyslogFacilityTopic
+	default:
+		return fmt.Errorf("syslog topic %q invalid, must be %q or %q", *syslogTopic, syslogTopicAppName, syslogTopicFacility)
+	}
+
+	// Every connection writes to the log with the same settings.
+	writerConfig := ingest.WriterConfig{
+		FlushAge:    *segmentFlushAge,
+		FlushSize:   *segmentFlushSize,
+		PerTopic:    *segmentPerTopic,
+		Bytes:       ingestWriterBytes,
+		Records:     ingestWriterRecords,
+		Syncs:       ingestWriterSyncs,
+		SegmentAge:  flushedSegmentAge,
+		SegmentSize: flushedSegmentSize,
+	}
+
+	// Drop records redelivered by producers, e.g. after reconnecting.
+	var dedup *ingest.Deduplicator
+	if *dedupWindow > 0 {
+		dedup = ingest.NewDeduplicator(*dedupWindow, duplicateRecords)
+	}
+
 	// Execution group.
 	var g group.Group
 	{
@@ -309,17 +665,32 @@ func runIngest(args []string) error {
 			close(cancel)
 		})
 	}
+	{
+		// Readers blocked on a full disk must be released before the
+		// connection handlers can return.
+		cancel := make(chan struct{})
+		g.Add(func() error {
+			<-cancel
+			return nil
+		}, func(error) {
+			close(cancel)
+			diskMonitor.Stop()
+		})
+	}
 	{
 		g.Add(func() error {
 			return ingest.HandleConnections(
 				fastListener,
 				ingest.HandleFastWriter,
+				"fast",
 				rfac,
+				idfac,
+				conns,
+				dedup,
+				unsupportedHellos,
 				ingestLog,
-				*segmentFlushAge, *segmentFlushSize,
+				writerConfig,
 				connectedClients.WithLabelValues("fast"),
-				ingestWriterBytes, ingestWriterRecords, ingestWriterSyncs,
-				flushedSegmentAge, flushedSegmentSize,
 			)
 		}, func(error) {
 			fastListener.Close()
@@ -328,12 +699,15 @@ func runIngest(args []string) error {
 			return ingest.HandleConnections(
 				durableListener,
 				ingest.HandleDurableWriter,
+				"durable",
 				rfac,
+				idfac,
+				conns,
+				dedup,
+				unsupportedHellos,
 				ingestLog,
-				*segmentFlushAge, *segmentFlushSize,
+				writerConfig,
 				connectedClients.WithLabelValues("durable"),
-				ingestWriterBytes, ingestWriterRecords, ingestWriterSyncs,
-				flushedSegmentAge, flushedSegmentSize,
 			)
 		}, func(error) {
 			durableListener.Close()
@@ -342,21 +716,68 @@ func runIngest(args []string) error {
 			return ingest.HandleConnections(
 				bulkListener,
 				ingest.HandleBulkWriter,
+				"bulk",
 				rfac,
+				idfac,
+				conns,
+				nil, // batches are read before they're written; the store drops duplicates
+				bulkUnsupportedHellos,
 				ingestLog,
-				*segmentFlushAge, *segmentFlushSize,
+				writerConfig,
 				connectedClients.WithLabelValues("bulk"),
-				ingestWriterBytes, ingestWriterRecords, ingestWriterSyncs,
-				flushedSegmentAge, flushedSegmentSize,
 			)
 		}, func(error) {
 			bulkListener.Close()
 		})
+		if syslogPacketConn != nil {
+			g.Add(func() error {
+				return ingest.HandleSyslogPackets(
+					syslogPacketConn,
+					syslogTopicFunc,
+					*recordMaxSize,
+					rateLimiter.ReaderFactory(record.RedactReaderFactory(record.NewDynamicReader, redactor, true)),
+					ingestLog,
+					writerConfig,
+				)
+			}, func(error) {
+				syslogPacketConn.Close()
+			})
+		}
+		if syslogListener != nil {
+			g.Add(func() error {
+				return ingest.HandleConnections(
+					syslogListener,
+					ingest.HandleFastWriter,
+					"syslog",
+					diskMonitor.ReaderFactory(rateLimiter.ReaderFactory(record.RedactReaderFactory(record.SyslogReaderFactory(syslogTopicFunc, *recordMaxSize), redactor, true))),
+					ingest.NewIDGenerator,
+					conns,
+					dedup,
+					nil,
+					ingestLog,
+					writerConfig,
+					connectedClients.WithLabelValues("syslog"),
+				)
+			}, func(error) {
+				syslogListener.Close()
+			})
+		}
 		g.Add(func() error {
+			pushWriter, err := ingest.NewWriter(ingestLog, writerConfig)
+			if err != nil {
+				return err
+			}
+			defer pushWriter.Stop()
 			mux := http.NewServeMux()
 			mux.Handle("/ingest/", http.StripPrefix("/ingest", ingest.NewAPI(
 				peer,
 				ingestLog,
+				pushWriter,
+				rfac,
+				topicReaderFactory,
+				idfac,
+				conns,
+				drainer,
 				*segmentPendingTimeout,
 				failedSegments,
 				committedSegments,
@@ -365,12 +786,20 @@ func runIngest(args []string) error {
 			)))
 			registerMetrics(mux)
 			registerProfile(mux)
-			registerHealthCheck(mux)
+			registerHealthCheck(mux, diskMonitor.Check)
 			return http.Serve(apiListener, cors.Default().Handler(mux))
 		}, func(error) {
 			apiListener.Close()
 		})
 	}
+	{
+		cancel := make(chan struct{})
+		g.Add(func() error {
+			return drain(drainer, peer, logger, cancel)
+		}, func(error) {
+			close(cancel)
+		})
+	}
 	{
 		cancel := make(chan struct{})
 		g.Add(func() error {
@@ -381,3 +810,36 @@ func runIngest(args []string) error {
 	}
 	return g.Run()
 }
+
+// drain waits for a drain to be started, via a signal or the API, and for it
+// to finish, logging progress. Then it leaves the cluster, and returns nil, so
+// the ingester shuts down.
+func drain(drainer *ingest.Drainer, peer *cluster.Peer, logger log.Logger, cancel <-chan struct{}) error {
+	c := make(chan os.Signal, 1)
+	if len(drainSignals) > 0 {
+		signal.Notify(c, drainSignals...)
+		defer signal.Stop(c)
+	}
+	select {
+	case sig := <-c:
+		level.Info(logger).Log("drain", "requested", "signal", sig)
+		drainer.Start()
+	case <-drainer.Started():
+		level.Info(logger).Log("drain", "requested", "via", "API")
+	case <-cancel:
+		return errors.New("canceled")
+	}
+	if err := drainer.Wait(defaultIngestDrainReportInterval, func(s ingest.DrainStatus) {
+		level.Info(logger).Log(
+			"drain", "progress",
+			"connections", s.Connections,
+			"active_bytes", s.ActiveBytes,
+			"flushed_segments", s.FlushedSegments,
+			"pending_segments", s.PendingSegments,
+		)
+	}, cancel); err != nil {
+		return err
+	}
+	level.Info(logger).Log("drain", "complete", "took", time.Since(drainer.Status().Started))
+	return peer.Leave(time.Second)
+}
@@ -9,6 +9,7 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
@@ -84,6 +85,10 @@ const (
 var (
 	defaultAPIAddr     = fmt.Sprintf("tcp://0.0.0.0:%d", defaultAPIPort)
 	defaultClusterAddr = fmt.Sprintf("tcp://0.0.0.0:%d", defaultClusterPort)
+
+	// Forwarders join the cluster on any free port, so they can run beside
+	// ingest and store nodes.
+	defaultForwardClusterAddr = "tcp://0.0.0.0:0"
 )
 
 type stringslice []string
@@ -100,6 +105,19 @@ func (ss *stringslice) String() string {
 	return strings.Join(*ss, ", ")
 }
 
+// compileRegexps compiles each of the expressions, e.g. from a repeatable flag.
+func compileRegexps(exprs []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, len(exprs))
+	for i, expr := range exprs {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = re
+	}
+	return res, nil
+}
+
 func interrupt(cancel <-chan struct{}) error {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
@@ -111,6 +129,14 @@ func interrupt(cancel <-chan struct{}) error {
 	}
 }
 
+// listenerPort returns the TCP port the listener is bound to, or zero.
+func listenerPort(ln net.Listener) int {
+	if addr, ok := ln.Addr().(*net.TCPAddr); ok {
+		return addr.Port
+	}
+	return 0
+}
+
 // "udp://host:1234", 80 => udp host:1234 host 1234
 // "host:1234", 80       => tcp host:1234 host 1234
 // "host", 80            => tcp host:80   host 80
@@ -145,8 +171,15 @@ func parseAddr(addr string, defaultPort int) (network, address, host string, por
 	return u.Scheme, u.Host, host, port, nil
 }
 
-func registerHealthCheck(mux *http.ServeMux) {
+func registerHealthCheck(mux *http.ServeMux, checks ...func() error) {
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		for _, check := range checks {
+			if err := check(); err != nil {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				fmt.Fprintln(w, err)
+				return
+			}
+		}
 		w.WriteHeader(http.StatusOK)
 		fmt.Fprintln(w, "OK")
 	})
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/oklog/oklog/pkg/record"
+)
+
+// loadRedactor reads redaction rules from the file at path, counting
+// redactions by rule.
+func loadRedactor(path string, redactions *prometheus.CounterVec) (*record.Redactor, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return record.ParseRedactor(f, redactions)
+}
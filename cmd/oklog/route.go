@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/go-logfmt/logfmt"
+	"github.com/pkg/errors"
+
+	"github.com/oklog/oklog/pkg/record"
+)
+
+// router picks a topic for each record, from the first rule that matches
+// it, or a default topic if none do. Rules are read from a file, one per
+// line, tried in order:
+//
+//	# comments and blank lines are ignored
+//	<topic> regexp <expression>   the record matches the expression
+//	<topic> field <name>=<value>  the record has the field, as logfmt or
+//	                              a JSON object
+//	default <topic>               for records no rule matches
+type router struct {
+	rules        []routeRule
+	defaultTopic string
+	fields       bool // some rule matches fields
+}
+
+type routeRule struct {
+	topic string
+	re    *regexp.Regexp
+	name  string
+	value string
+}
+
+func loadRouter(path string) (*router, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseRouter(f)
+}
+
+func parseRouter(r io.Reader) (*router, error) {
+	var (
+		rt = &router{}
+		s  = bufio.NewScanner(r)
+	)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		topic, rest := splitWord(line)
+		if topic == "default" {
+			if rest == "" || strings.ContainsAny(rest, " \t") {
+				return nil, fmt.Errorf("line %d: want default <topic>", n)
+			}
+			if rt.defaultTopic != "" {
+				return nil, fmt.Errorf("line %d: default topic repeated", n)
+			}
+			if !record.IsValidTopic([]byte(rest)) {
+				return nil, fmt.Errorf("line %d: topic %q invalid", n, rest)
+			}
+			rt.defaultTopic = rest
+			continue
+		}
+		if !record.IsValidTopic([]byte(topic)) {
+			return nil, fmt.Errorf("line %d: topic %q invalid", n, topic)
+		}
+		kind, match := splitWord(rest)
+		if match == "" {
+			return nil, fmt.Errorf("line %d: want <topic> regexp <expression>, or <topic> field <name>=<value>", n)
+		}
+		switch kind {
+		case "regexp":
+			re, err := regexp.Compile(match)
+			if err != nil {
+				return nil, errors.Wrapf(err, "line %d", n)
+			}
+			rt.rules = append(rt.rules, routeRule{topic: topic, re: re})
+		case "field":
+			i := strings.IndexByte(match, '=')
+			if i <= 0 {
+				return nil, fmt.Errorf("line %d: want field <name>=<value>", n)
+			}
+			rt.rules = append(rt.rules, routeRule{topic: topic, name: match[:i], value: match[i+1:]})
+			rt.fields = true
+		default:
+			return nil, fmt.Errorf("line %d: match %q invalid, must be regexp or field", n, kind)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if rt.defaultTopic == "" {
+		return nil, errors.New("no default topic")
+	}
+	return rt, nil
+}
+
+// splitWord splits s around its first run of whitespace.
+func splitWord(s string) (string, string) {
+	i := strings.IndexAny(s, " \t")
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], strings.TrimSpace(s[i:])
+}
+
+// route returns the topic for the record.
+func (rt *router) route(rec []byte) string {
+	var fields map[string]string
+	if rt.fields {
+		fields = recordFields(rec)
+	}
+	for _, rule := range rt.rules {
+		if rule.re != nil {
+			if rule.re.Match(rec) {
+				return rule.topic
+			}
+			continue
+		}
+		if v, ok := fields[rule.name]; ok && v == rule.value {
+			return rule.topic
+		}
+	}
+	return rt.defaultTopic
+}
+
+// recordFields returns the fields of a record that's a JSON object, or else
+// the key=value pairs in it, as logfmt. Values other than JSON strings are
+// formatted as they'd appear in JSON.
+func recordFields(rec []byte) map[string]string {
+	fields := map[string]string{}
+	if trimmed := bytes.TrimSpace(rec); len(trimmed) > 0 && trimmed[0] == '{' {
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(trimmed, &obj); err == nil {
+			for k, raw := range obj {
+				var s string
+				if err := json.Unmarshal(raw, &s); err == nil {
+					fields[k] = s
+				} else {
+					fields[k] = string(raw)
+				}
+			}
+			return fields
+		}
+	}
+	d := logfmt.NewDecoder(bytes.NewReader(rec))
+	for d.ScanRecord() {
+		for d.ScanKeyval() {
+			if _, ok := fields[string(d.Key())]; !ok {
+				fields[string(d.Key())] = string(d.Value())
+			}
+		}
+	}
+	return fields // as far as it parsed
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRouter(t *testing.T) {
+	rt, err := parseRouter(strings.NewReader(`
+# Access logs, then app logs by level.
+access  regexp ^\S+ \S+ \S+ \[
+errors  field  level=error
+errors  field  severity=ERROR
+default app
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, testcase := range []struct {
+		rec  string
+		want string
+	}{
+		{`127.0.0.1 - - [10/Oct/2026:13:55:36 +0000] "GET / HTTP/1.1" 200 2326` + "\n", "access"},
+		{`ts=2026-10-17 level=error msg="disk full"` + "\n", "errors"},
+		{`ts=2026-10-17 level=info msg="level=error"` + "\n", "app"},
+		{`{"severity":"ERROR","msg":"boom"}` + "\n", "errors"},
+		{`{"severity":"INFO","level":"info"}` + "\n", "app"},
+		{"plain text\n", "app"},
+	} {
+		if have := rt.route([]byte(testcase.rec)); testcase.want != have {
+			t.Errorf("%q: want %q, have %q", testcase.rec, testcase.want, have)
+		}
+	}
+}
+
+func TestParseRouterErrors(t *testing.T) {
+	for _, input := range []string{
+		"access regexp ^GET\n",         // no default
+		"default app\ndefault other\n", // repeated default
+		"default bad/topic\n",
+		"access regexp (\ndefault app\n",
+		"access field level\ndefault app\n",
+		"access glob *\ndefault app\n",
+	} {
+		if _, err := parseRouter(strings.NewReader(input)); err == nil {
+			t.Errorf("%q: want error, have none", input)
+		}
+	}
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/oklog/oklog/pkg/record"
+)
+
+// spoolOverflow says what happens to records read while the spool is full.
+type spoolOverflow string
+
+const (
+	// spoolBlock stops reading the input until there's room in the spool.
+	spoolBlock spoolOverflow = "block"
+
+	// spoolDropOldest discards the oldest records in the spool to make room.
+	spoolDropOldest spoolOverflow = "drop-oldest"
+)
+
+func parseSpoolOverflow(s string) (spoolOverflow, error) {
+	switch p := spoolOverflow(s); p {
+	case spoolBlock, spoolDropOldest:
+		return p, nil
+	default:
+		return "", fmt.Errorf("spool overflow policy %q invalid, must be %q or %q", s, spoolBlock, spoolDropOldest)
+	}
+}
+
+const (
+	defaultSpoolMaxSize = 1024 * 1024 * 1024
+
+	spoolFileSize = 16 * 1024 * 1024 // bytes per spool file, roughly
+	spoolExt      = ".spool"
+)
+
+// spool holds records between the input and the connection to an ingester,
+// so the input is still read while no ingester is reachable. Records are
+// written through to files in a directory, and replayed from there in order,
+// so none are lost if the forwarder crashes. Records read from the spool are
+// held until they're committed, once forwarded, so a record whose forwarding
+// fails is still spooled; files are deleted once all their records are
+// committed. Records left in the directory by a previous run are replayed
+// first, including those already committed since the spool was last drained.
+// A spool without a directory holds records in memory instead. In place of
+// records dropped to make room, the reader gets a summary record saying how
+// many there were, built by summary.
+//
+// Each record in a spool file is its length, as a uvarint, and its bytes.
+type spool struct {
+	dir        string // or empty, in memory
+	max        int64
+	maxRecords int // or zero, unlimited
+	overflow   spoolOverflow
+	summary    func(dropped int) []byte
+	depth      prometheus.Gauge
+	size       prometheus.Gauge
+	dropped    prometheus.Counter
+
+	mtx     sync.Mutex
+	cond    *sync.Cond
+	mem     [][]byte     // oldest first, in memory, not yet read
+	lost    int          // records dropped since the last read
+	sent    []sentRecord // read but not yet committed, oldest first
+	unsent  int          // records held, not yet read
+	files   []*spoolFile // oldest first; the last one is written
+	next    int          // number of the next file
+	w       *os.File
+	wsz     int64
+	r       *os.File
+	br      *bufio.Reader
+	rfile   int   // index of the file read, in files
+	records int   // records held, including those read but not committed
+	bytes   int64 // bytes held, including those read but not committed
+	err     error // once the input fails
+	cerr    error // once committing fails
+}
+
+// spoolFile is a spool file, with the number of its records not yet
+// committed or dropped.
+type spoolFile struct {
+	path    string
+	records int
+}
+
+// sentRecord is a record read from the spool, but not yet committed.
+type sentRecord struct {
+	size    int64
+	file    *spoolFile // or nil, in memory
+	summary bool       // not held by the spool
+}
+
+// newSpool returns a spool holding at most max bytes of records in dir,
+// with any records left there. Spooled records and bytes are reported in
+// depth and size, and records dropped to make room in dropped.
+func newSpool(dir string, max int64, overflow spoolOverflow, summary func(dropped int) []byte, depth, size prometheus.Gauge, dropped prometheus.Counter) (*spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, "*"+spoolExt))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(matches) // zero-padded numbers
+	s := &spool{
+		dir:      dir,
+		max:      max,
+		overflow: overflow,
+		summary:  summary,
+		depth:    depth,
+		size:     size,
+		dropped:  dropped,
+	}
+	s.cond = sync.NewCond(&s.mtx)
+	for _, path := range matches {
+		n, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(path), spoolExt))
+		if err != nil {
+			continue // not ours
+		}
+		records, sz, err := recoverSpoolFile(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "recovering %s", path)
+		}
+		if records > 0 {
+			s.files = append(s.files, &spoolFile{path: path, records: records})
+			s.records += records
+			s.bytes += sz
+		} else if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+		s.next = n + 1
+	}
+	s.unsent = s.records
+	s.depth.Set(float64(s.records))
+	s.size.Set(float64(s.bytes))
+	return s, nil
+}
+
+// newMemorySpool returns a spool holding at most max records in memory,
+// which drops the oldest unread ones when it's full, so the input is drained.
+func newMemorySpool(max int, summary func(dropped int) []byte, depth, size prometheus.Gauge, dropped prometheus.Counter) *spool {
+	s := &spool{
+		max:        math.MaxInt64,
+		maxRecords: max,
+		overflow:   spoolDropOldest,
+		summary:    summary,
+		depth:      depth,
+		size:       size,
+		dropped:    dropped,
+	}
+	s.cond = sync.NewCond(&s.mtx)
+	return s
+}
+
+// recoverSpoolFile counts the records in a spool file, and truncates it
+// after the last complete one, in case it was torn by a crash.
+func recoverSpoolFile(path string) (records int, sz int64, err error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	var (
+		br     = bufio.NewReader(f)
+		offset int64
+	)
+	for {
+		n, err := readSpoolRecord(br, ioutil.Discard)
+		if err == io.EOF {
+			return records, sz, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			return records, sz, f.Truncate(offset)
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		offset += int64(uvarintLen(n)) + n
+		records++
+		sz += n
+	}
+}
+
+// fill puts records from read into the spool, until read fails, calling
+// spooled for each one. Once the spool is drained, its read returns the error.
+func (s *spool) fill(read record.Reader, spooled func(n int)) {
+	for {
+		rec, err := read()
+		if err == nil {
+			if err = s.put(rec); err == nil {
+				spooled(1)
+			}
+		}
+		if err != nil {
+			s.mtx.Lock()
+			s.err = err
+			s.cond.Broadcast()
+			s.mtx.Unlock()
+			return
+		}
+	}
+}
+
+// put a record in the spool, making room for it according to the overflow
+// policy. A record bigger than the whole spool is still accepted when the
+// spool is empty. Records read but not yet committed aren't dropped; while
+// they fill the spool, it's accepted as if the spool were empty.
+func (s *spool) put(rec []byte) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for s.records > 0 && (s.bytes+int64(len(rec)) > s.max || s.maxRecords > 0 && s.records >= s.maxRecords) {
+		if s.overflow == spoolBlock {
+			s.cond.Wait()
+			continue
+		}
+		if s.unsent <= 0 {
+			break
+		}
+		oldest, f, err := s.take()
+		if err != nil {
+			return err
+		}
+		if err := s.release(int64(len(oldest)), f); err != nil {
+			return err
+		}
+		s.lost++
+		s.dropped.Inc()
+	}
+
+	if s.dir == "" {
+		s.mem = append(s.mem, append([]byte{}, rec...))
+	} else if err := s.spill(rec); err != nil {
+		return errors.Wrap(err, "spooling")
+	}
+	s.records++
+	s.unsent++
+	s.bytes += int64(len(rec))
+	s.depth.Set(float64(s.records))
+	s.size.Set(float64(s.bytes))
+	s.cond.Broadcast()
+	return nil
+}
+
+// read is a record.Reader for the records in the spool, oldest first. They're
+// held by the spool until they're committed.
+func (s *spool) read() ([]byte, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for s.unsent <= 0 && s.lost <= 0 && s.err == nil && s.cerr == nil {
+		s.cond.Wait()
+	}
+	if s.cerr != nil {
+		return nil, s.cerr
+	}
+	if s.lost > 0 {
+		rec := s.summary(s.lost)
+		s.lost = 0
+		s.sent = append(s.sent, sentRecord{summary: true})
+		return rec, nil
+	}
+	if s.unsent <= 0 {
+		return nil, s.err
+	}
+	rec, f, err := s.take()
+	if err != nil {
+		return nil, errors.Wrap(err, "reading spool")
+	}
+	s.sent = append(s.sent, sentRecord{size: int64(len(rec)), file: f})
+	return rec, nil
+}
+
+// commit releases the oldest n records read from the spool, once they're
+// forwarded. If that fails, the next read returns the error.
+func (s *spool) commit(n int) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if n > len(s.sent) {
+		n = len(s.sent)
+	}
+	for _, r := range s.sent[:n] {
+		if r.summary {
+			continue
+		}
+		if err := s.release(r.size, r.file); err != nil && s.cerr == nil {
+			s.cerr = errors.Wrap(err, "committing spool")
+		}
+	}
+	s.sent = s.sent[n:]
+	s.cond.Broadcast()
+}
+
+// take reads the oldest record not yet read, and returns it, with the spool
+// file it's in, if any.
+func (s *spool) take() ([]byte, *spoolFile, error) {
+	if s.dir == "" {
+		var rec []byte
+		rec, s.mem[0], s.mem = s.mem[0], nil, s.mem[1:]
+		s.unsent--
+		return rec, nil, nil
+	}
+	var buf bytes.Buffer
+	for {
+		if s.r == nil {
+			f, err := os.Open(s.files[s.rfile].path)
+			if err != nil {
+				return nil, nil, err
+			}
+			s.r, s.br = f, bufio.NewReader(f)
+		}
+		_, err := readSpoolRecord(s.br, &buf)
+		if err == io.EOF && s.rfile < len(s.files)-1 {
+			s.r.Close()
+			s.r, s.br = nil, nil
+			s.rfile++
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		s.unsent--
+		return buf.Bytes(), s.files[s.rfile], nil
+	}
+}
+
+// release a record taken from the spool, once it's committed or dropped.
+// Spool files are deleted once all their records are released, and the
+// spool is emptied once the last one is.
+func (s *spool) release(size int64, f *spoolFile) error {
+	s.records--
+	s.bytes -= size
+	s.depth.Set(float64(s.records))
+	s.size.Set(float64(s.bytes))
+	if f != nil {
+		f.records--
+	}
+	for len(s.files) > 0 && s.files[0].records <= 0 && (len(s.files) > 1 || s.w == nil) {
+		if err := s.removeFile(); err != nil {
+			return err
+		}
+	}
+	if s.records <= 0 && s.w != nil {
+		return s.empty()
+	}
+	return nil
+}
+
+// spill writes a record to the newest spool file.
+func (s *spool) spill(rec []byte) error {
+	if s.w == nil || s.wsz >= spoolFileSize {
+		if s.w != nil {
+			if err := s.w.Close(); err != nil {
+				return err
+			}
+		}
+		path := filepath.Join(s.dir, fmt.Sprintf("%020d%s", s.next, spoolExt))
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return err
+		}
+		s.files = append(s.files, &spoolFile{path: path})
+		s.next++
+		s.w, s.wsz = f, 0
+	}
+	buf := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(rec))
+	buf = append(buf[:binary.PutUvarint(buf, uint64(len(rec)))], rec...)
+	if _, err := s.w.Write(buf); err != nil {
+		return err
+	}
+	s.wsz += int64(len(buf))
+	s.files[len(s.files)-1].records++
+	return nil
+}
+
+// empty truncates the file being written, once every record in the spool is
+// released, so it's kept for the next records, rather than recreated, and
+// they're not replayed after a restart.
+func (s *spool) empty() error {
+	if err := s.w.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := s.w.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	s.wsz = 0
+	if s.r != nil { // reading the same file
+		if _, err := s.r.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		s.br.Reset(s.r)
+	}
+	return nil
+}
+
+// removeFile closes and deletes the oldest spool file.
+func (s *spool) removeFile() error {
+	if s.rfile > 0 {
+		s.rfile--
+	} else if s.r != nil {
+		s.r.Close()
+		s.r, s.br = nil, nil
+	}
+	if err := os.Remove(s.files[0].path); err != nil {
+		return err
+	}
+	s.files = s.files[1:]
+	return nil
+}
+
+// readSpoolRecord copies the next record from br to w, and returns its
+// length. It returns io.EOF if there are no more records, and
+// io.ErrUnexpectedEOF if the last one is incomplete.
+func readSpoolRecord(br *bufio.Reader, w io.Writer) (int64, error) {
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return 0, err // io.EOF or io.ErrUnexpectedEOF, as we want
+	}
+	if _, err := io.CopyN(w, br, int64(n)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	return int64(n), nil
+}
+
+func uvarintLen(n int64) int {
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buf[:], uint64(n))
+}
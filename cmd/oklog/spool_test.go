@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSpool(t *testing.T) {
+	dir := t.TempDir()
+	open := func(max int64, overflow spoolOverflow) (*spool, prometheus.Counter) {
+		dropped := prometheus.NewCounter(prometheus.CounterOpts{})
+		s, err := newSpool(
+			dir, max, overflow, dropSummary,
+			prometheus.NewGauge(prometheus.GaugeOpts{}),
+			prometheus.NewGauge(prometheus.GaugeOpts{}),
+			dropped,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s, dropped
+	}
+	record := func(i int) string { return fmt.Sprintf("record %05d\n", i) }
+
+	// Records are written through to disk, and read in order.
+	s, _ := open(1024*1024, spoolBlock)
+	n := 3000
+	for i := 0; i < n; i++ {
+		if err := s.put([]byte(record(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.wsz <= 0 {
+		t.Fatalf("no records written to disk")
+	}
+	for i := 0; i < 10; i++ {
+		if rec, err := s.read(); err != nil || string(rec) != record(i) {
+			t.Fatalf("read %d: want %q, have %q, %v", i, record(i), rec, err)
+		}
+	}
+
+	// They survive a restart, even if the last one is torn. Those read since
+	// the spool was last drained are replayed.
+	s.w.Write([]byte{200}) // the start of a long record's length
+	s.w.Close()
+	s.r.Close()
+	s, _ = open(1024*1024, spoolBlock)
+	if want, have := n, s.records; want != have {
+		t.Fatalf("after restart: want %d records, have %d", want, have)
+	}
+	s.put([]byte("new\n"))
+	go s.fill(func() ([]byte, error) { return nil, io.EOF }, func(int) {})
+	for i := 0; i < n; i++ {
+		if rec, err := s.read(); err != nil || string(rec) != record(i) {
+			t.Fatalf("read %d after restart: want %q, have %q, %v", i, record(i), rec, err)
+		}
+	}
+	if rec, err := s.read(); err != nil || string(rec) != "new\n" {
+		t.Fatalf("want new record, have %q, %v", rec, err)
+	}
+	if _, err := s.read(); err != io.EOF {
+		t.Fatalf("want EOF once drained, have %v", err)
+	}
+
+	// Records are held until they're committed.
+	if files, _ := ioutil.ReadDir(dir); len(files) <= 1 {
+		t.Fatalf("before commit, want the spool files kept, have %d", len(files))
+	}
+	s.commit(n + 1)
+
+	// Once drained, nothing is replayed, and the file being written is kept
+	// for the next records.
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 || files[0].Size() != 0 {
+		t.Fatalf("once drained, want one empty spool file, have %d files", len(files))
+	}
+	s.w.Close()
+	if s, _ = open(1024*1024, spoolBlock); s.records != 0 {
+		t.Fatalf("after drained restart: want no records, have %d", s.records)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) > 0 {
+		t.Errorf("empty spool files left after restart: %d", len(files))
+	}
+
+	// Drained in turn, records are read from the start of the kept file.
+	s.put([]byte(record(0)))
+	if rec, _ := s.read(); string(rec) != record(0) {
+		t.Fatalf("want %q, have %q", record(0), rec)
+	}
+	s.commit(1)
+	s.put([]byte(record(1)))
+	if rec, _ := s.read(); string(rec) != record(1) {
+		t.Fatalf("want %q, have %q", record(1), rec)
+	}
+	s.commit(1)
+	if s.wsz != 0 {
+		t.Errorf("drained spool file not truncated: %d bytes", s.wsz)
+	}
+
+	// When full, the oldest records are dropped, but not those read and
+	// not yet committed.
+	s, dropped := open(int64(3*len(record(0))), spoolDropOldest)
+	s.put([]byte(record(0)))
+	if rec, _ := s.read(); string(rec) != record(0) {
+		t.Fatalf("want %q, have %q", record(0), rec)
+	}
+	for i := 1; i < 5; i++ {
+		s.put([]byte(record(i)))
+	}
+	if want, have := 2.0, testutil.ToFloat64(dropped); want != have {
+		t.Errorf("dropped: want %v, have %v", want, have)
+	}
+	for _, want := range []string{"dropped 2 records\n", record(3)} {
+		if rec, _ := s.read(); string(rec) != want {
+			t.Errorf("want %q, have %q", want, rec)
+		}
+	}
+	s.commit(3)
+	if want, have := 1, s.records; want != have {
+		t.Errorf("after commit: want %d records, have %d", want, have)
+	}
+}
+
+func TestSpoolFailedWrite(t *testing.T) {
+	s, err := newSpool(
+		t.TempDir(), 1024, spoolBlock, dropSummary,
+		prometheus.NewGauge(prometheus.GaugeOpts{}),
+		prometheus.NewGauge(prometheus.GaugeOpts{}),
+		prometheus.NewCounter(prometheus.CounterOpts{}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range []string{"a\n", "b\n"} {
+		if err := s.put([]byte(rec)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	go s.fill(func() ([]byte, error) { return nil, io.EOF }, func(int) {})
+	var (
+		unsent  = &unsentRecords{commit: s.commit}
+		format  = func(rec []byte) string { return string(rec) }
+		counter = func() prometheus.Counter { return prometheus.NewCounter(prometheus.CounterOpts{}) }
+	)
+
+	// The record whose write fails stays in the spool.
+	if _, _, err := forwardFast(&failingWriter{n: 1}, s.read, format, nil, time.Hour, unsent, counter(), counter(), counter()); err == nil {
+		t.Fatal("want the connection to fail")
+	}
+	if want, have := 1, s.records; want != have {
+		t.Fatalf("after the failed write: want %d records spooled, have %d", want, have)
+	}
+
+	// It's delivered on the next connection, and only then released.
+	var buf bytes.Buffer
+	if _, exhausted, err := forwardFast(&buf, s.read, format, nil, time.Hour, unsent, counter(), counter(), counter()); !exhausted || err != io.EOF {
+		t.Fatalf("want exhausted with %v, have %v, %v", io.EOF, exhausted, err)
+	}
+	if want, have := "b\n", buf.String(); want != have {
+		t.Errorf("want %q, have %q", want, have)
+	}
+	if want, have := 0, s.records; want != have {
+		t.Errorf("want %d records spooled, have %d", want, have)
+	}
+}
+
+func TestMemorySpool(t *testing.T) {
+	var (
+		dropped = prometheus.NewCounter(prometheus.CounterOpts{})
+		s       = newMemorySpool(3, dropSummary, prometheus.NewGauge(prometheus.GaugeOpts{}), prometheus.NewGauge(prometheus.GaugeOpts{}), dropped)
+	)
+	for i := 1; i <= 5; i++ {
+		if err := s.put([]byte(fmt.Sprintf("record %d\n", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	go s.fill(func() ([]byte, error) { return nil, io.EOF }, func(int) {})
+
+	for _, want := range []string{
+		"dropped 2 records\n",
+		"record 3\n",
+		"record 4\n",
+		"record 5\n",
+	} {
+		rec, err := s.read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have := string(rec); want != have {
+			t.Errorf("want %q, have %q", want, have)
+		}
+	}
+	if _, err := s.read(); err != io.EOF {
+		t.Errorf("want EOF once drained, have %v", err)
+	}
+	if want, have := 2.0, testutil.ToFloat64(dropped); want != have {
+		t.Errorf("dropped: want %v, have %v", want, have)
+	}
+}
+
+func TestSpoolIgnoresOtherFiles(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "notes.spool"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := newSpool(
+		dir, 1024, spoolBlock, dropSummary,
+		prometheus.NewGauge(prometheus.GaugeOpts{}),
+		prometheus.NewGauge(prometheus.GaugeOpts{}),
+		prometheus.NewCounter(prometheus.CounterOpts{}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.records != 0 {
+		t.Errorf("want no records, have %d", s.records)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "notes.spool")); err != nil {
+		t.Error(err)
+	}
+}
@@ -84,8 +84,10 @@ func runStore(args []string) error {
 		uiLocal                   = flagset.Bool("ui.local", false, "ignore embedded files and go straight to the filesystem")
 		filesystem                = flagset.String("filesystem", defaultFilesystem, "real, virtual, nop")
 		clusterPeers              = stringslice{}
+		priorityTopics            = stringslice{}
 	)
 	flagset.Var(&clusterPeers, "peer", "cluster peer host:port (repeatable)")
+	flagset.Var(&priorityTopics, "store.priority-topic", "optional, topic whose segments are consumed before others, from ingesters writing segments per topic (repeatable)")
 	flagset.Usage = usageFor(flagset, "oklog store [flags]")
 	if err := flagset.Parse(args); err != nil {
 		return err
@@ -313,6 +315,7 @@ func runStore(args []string) error {
 			*segmentTargetAge,
 			*segmentDelay,
 			*segmentReplicationFactor,
+			priorityTopics,
 			consumedSegments,
 			consumedBytes,
 			replicatedSegments.WithLabelValues("egress"),
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultFilePollInterval = time.Second
+	fileCheckpointInterval  = time.Second
+	fileReadBatch           = 1024 // records from one file before moving on to the next
+)
+
+// fileInput is a glob pattern of files to tail, and the prefix for their
+// records, e.g. a topic.
+type fileInput struct {
+	pattern string
+	prefix  string
+}
+
+// parseFileInput parses a glob pattern, optionally followed by a space and
+// the prefix for records from the matching files.
+func parseFileInput(s string) (fileInput, error) {
+	fields := strings.SplitN(strings.TrimSpace(s), " ", 2)
+	in := fileInput{pattern: fields[0]}
+	if _, err := filepath.Match(in.pattern, ""); in.pattern == "" || err != nil {
+		return fileInput{}, errors.Errorf("file pattern %q invalid", s)
+	}
+	if len(fields) == 2 {
+		if prefix := strings.TrimSpace(fields[1]); prefix != "" {
+			in.prefix = prefix + " "
+		}
+	}
+	return in, nil
+}
+
+// fileKey identifies a tailed file, across renames where the platform allows.
+type fileKey struct {
+	dev, ino uint64
+	path     string // where files have no identity
+}
+
+func fileKeyOf(path string, fi os.FileInfo) fileKey {
+	if dev, ino, ok := fileIdentity(fi); ok {
+		return fileKey{dev: dev, ino: ino}
+	}
+	return fileKey{path: path}
+}
+
+// fileCheckpoint is the offset of the first record in a file that hasn't
+// been forwarded yet.
+type fileCheckpoint struct {
+	Path   string `json:"path"`
+	Dev    uint64 `json:"dev,omitempty"`
+	Ino    uint64 `json:"ino,omitempty"`
+	Offset int64  `json:"offset"`
+}
+
+func (c fileCheckpoint) key() fileKey {
+	if c.Dev != 0 || c.Ino != 0 {
+		return fileKey{dev: c.Dev, ino: c.Ino}
+	}
+	return fileKey{path: c.Path}
+}
+
+// tailer follows the files matching some glob patterns, as they're written,
+// renamed away and replaced, or truncated, and reads records from them, one
+// per line. Files are polled for new data, and new files. A file renamed so
+// that it no longer matches is read to the end, and closed.
+//
+// Records are read in order, and the offset of each is checkpointed once
+// it's committed, i.e. once the forwarder is done with it. Checkpoints are
+// saved to a file periodically, and once the tailer is closed, and tailing
+// resumes from them after a restart. Files without a checkpoint are read
+// from the start.
+type tailer struct {
+	inputs  []fileInput
+	poll    time.Duration
+	path    string // for checkpoints; optional
+	maxLine int
+	label   func(prefix string, line []byte) []byte
+	logger  log.Logger
+
+	files   map[fileKey]*tailedFile // owned by run
+	records chan tailedRecord
+	stop    chan struct{}
+	stopped chan struct{}
+
+	mtx         sync.Mutex
+	uncommitted []tailedRecord // read, oldest first, without their records
+	checkpoints map[fileKey]fileCheckpoint
+	dirty       bool
+	saved       time.Time
+}
+
+type tailedRecord struct {
+	key    fileKey
+	offset int64 // after the record
+	prefix string
+	record []byte
+}
+
+// newTailer starts tailing the files matching inputs, from the checkpoints
+// saved in path, if there are any. Lines longer than maxLine are split. Each
+// record is built by label, from the prefix of its input, and the line.
+func newTailer(inputs []fileInput, path string, poll time.Duration, maxLine int, label func(prefix string, line []byte) []byte, logger log.Logger) (*tailer, error) {
+	t := &tailer{
+		inputs:      inputs,
+		poll:        poll,
+		path:        path,
+		maxLine:     maxLine,
+		label:       label,
+		logger:      logger,
+		files:       map[fileKey]*tailedFile{},
+		records:     make(chan tailedRecord),
+		stop:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+		checkpoints: map[fileKey]fileCheckpoint{},
+	}
+	if path != "" {
+		buf, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if len(buf) > 0 {
+			var checkpoints []fileCheckpoint
+			if err := json.Unmarshal(buf, &checkpoints); err != nil {
+				return nil, errors.Wrapf(err, "parsing checkpoints in %s", path)
+			}
+			for _, c := range checkpoints {
+				t.checkpoints[c.key()] = c
+			}
+		}
+	}
+	go t.run()
+	return t, nil
+}
+
+// read is a record.Reader for the records in the tailed files. It returns
+// io.EOF once the tailer is closed.
+func (t *tailer) read() ([]byte, error) {
+	select {
+	case r := <-t.records:
+		t.mtx.Lock()
+		t.uncommitted = append(t.uncommitted, tailedRecord{key: r.key, offset: r.offset})
+		t.mtx.Unlock()
+		return t.label(r.prefix, r.record), nil
+	case <-t.stopped:
+		if err := t.save(true); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+}
+
+// close stops tailing, and saves the checkpoints.
+func (t *tailer) close() error {
+	close(t.stop)
+	<-t.stopped
+	return t.save(true)
+}
+
+func (t *tailer) run() {
+	defer close(t.stopped)
+	defer func() {
+		for _, f := range t.files {
+			f.f.Close()
+		}
+	}()
+	ticker := time.NewTicker(t.poll)
+	defer ticker.Stop()
+	for {
+		t.scan()
+		for {
+			n, ok := t.readFiles()
+			if !ok {
+				return
+			}
+			if err := t.save(false); err != nil {
+				level.Warn(t.logger).Log("checkpoints", t.path, "err", err)
+			}
+			if n <= 0 {
+				break
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// scan opens files newly matching the inputs, and marks those no longer
+// matching as gone.
+func (t *tailer) scan() {
+	seen := map[fileKey]bool{}
+	for _, in := range t.inputs {
+		matches, _ := filepath.Glob(in.pattern) // the pattern was validated
+		for _, path := range matches {
+			fi, err := os.Stat(path)
+			if err != nil || !fi.Mode().IsRegular() {
+				continue
+			}
+			key := fileKeyOf(path, fi)
+			if seen[key] {
+				continue // matched by an earlier input
+			}
+			seen[key] = true
+			if f, ok := t.files[key]; ok {
+				if f.path != path {
+					t.rename(key, f, path)
+				}
+				continue
+			}
+			f, err := t.open(path, key, fi.Size(), in.prefix)
+			if err != nil {
+				level.Warn(t.logger).Log("tail", path, "err", err)
+				continue
+			}
+			t.files[key] = f
+		}
+	}
+	for key, f := range t.files {
+		f.gone = !seen[key]
+	}
+
+	// Forget checkpoints of files that are gone.
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	for key := range t.checkpoints {
+		if _, ok := t.files[key]; !ok {
+			delete(t.checkpoints, key)
+			t.dirty = true
+		}
+	}
+}
+
+func (t *tailer) open(path string, key fileKey, size int64, prefix string) (*tailedFile, error) {
+	t.mtx.Lock()
+	c, ok := t.checkpoints[key]
+	t.mtx.Unlock()
+	if !ok || c.Offset > size {
+		c = fileCheckpoint{Path: path, Dev: key.dev, Ino: key.ino} // from the start
+	}
+	c.Path = path
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(c.Offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	t.mtx.Lock()
+	t.checkpoints[key] = c
+	t.dirty = true
+	t.mtx.Unlock()
+	level.Info(t.logger).Log("tail", path, "offset", c.Offset)
+	return &tailedFile{
+		path:    path,
+		prefix:  prefix,
+		f:       f,
+		offset:  c.Offset,
+		maxLine: t.maxLine,
+	}, nil
+}
+
+// readFiles reads a batch of records from each file, and returns how many
+// records it read. It returns false if the tailer is stopped meanwhile.
+func (t *tailer) readFiles() (n int, ok bool) {
+	for key, f := range t.files {
+		for i := 0; i < fileReadBatch; i++ {
+			rec, err := f.next()
+			if err != nil {
+				level.Warn(t.logger).Log("tail", f.path, "err", err)
+				t.remove(key, f)
+				break
+			}
+			if rec == nil {
+				if f.gone {
+					level.Info(t.logger).Log("tail", f.path, "closed", "file gone")
+					t.remove(key, f)
+				}
+				break
+			}
+			select {
+			case t.records <- tailedRecord{key, f.offset, f.prefix, rec}:
+				n++
+			case <-t.stop:
+				return n, false
+			}
+		}
+	}
+	return n, true
+}
+
+func (t *tailer) rename(key fileKey, f *tailedFile, path string) {
+	level.Info(t.logger).Log("tail", f.path, "renamed_to", path)
+	f.path = path
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if c, ok := t.checkpoints[key]; ok {
+		c.Path = path
+		t.checkpoints[key] = c
+		t.dirty = true
+	}
+}
+
+func (t *tailer) remove(key fileKey, f *tailedFile) {
+	f.f.Close()
+	delete(t.files, key)
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	delete(t.checkpoints, key)
+	t.dirty = true
+}
+
+// commit the oldest n records read, checkpointing the offsets after them.
+// Records from files no longer tailed are ignored.
+func (t *tailer) commit(n int) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if n > len(t.uncommitted) {
+		n = len(t.uncommitted)
+	}
+	for _, r := range t.uncommitted[:n] {
+		c, ok := t.checkpoints[r.key]
+		if !ok {
+			continue
+		}
+		c.Offset = r.offset
+		t.checkpoints[r.key] = c
+		t.dirty = true
+	}
+	t.uncommitted = t.uncommitted[n:]
+}
+
+// save the checkpoints, if they changed, at most once per interval unless
+// forced.
+func (t *tailer) save(force bool) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.path == "" || !t.dirty || (!force && time.Since(t.saved) < fileCheckpointInterval) {
+		return nil
+	}
+	checkpoints := make([]fileCheckpoint, 0, len(t.checkpoints))
+	for _, c := range t.checkpoints {
+		checkpoints = append(checkpoints, c)
+	}
+	sort.Slice(checkpoints, func(i, j int) bool { return checkpoints[i].Path < checkpoints[j].Path })
+	buf, err := json.MarshalIndent(checkpoints, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(t.path, buf); err != nil {
+		return err
+	}
+	t.dirty, t.saved = false, time.Now()
+	return nil
+}
+
+// writeFileAtomic replaces the file at path with buf, via a temporary file,
+// so readers never see part of it.
+func writeFileAtomic(path string, buf []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// tailedFile reads lines from a file as they're written.
+type tailedFile struct {
+	path    string
+	prefix  string // of the input it matched
+	f       *os.File
+	offset  int64  // of the first byte not yet returned
+	buf     []byte // read past offset, without a newline
+	scratch []byte
+	maxLine int
+	gone    bool // no longer matches the inputs
+}
+
+// next returns the next line in the file, or nil if there isn't a complete
+// one yet. Once the file is gone, its last line is returned even without a
+// newline. If the file is truncated, it's read from the start, unless it grew
+// past the last offset again before we noticed.
+func (f *tailedFile) next() ([]byte, error) {
+	if f.scratch == nil {
+		f.scratch = make([]byte, 32*1024)
+	}
+	for {
+		if i := bytes.IndexByte(f.buf, '\n'); i >= 0 {
+			return f.emit(i + 1), nil
+		}
+		if f.maxLine > 0 && len(f.buf) >= f.maxLine {
+			return f.emit(f.maxLine), nil
+		}
+		n, err := f.f.Read(f.scratch)
+		f.buf = append(f.buf, f.scratch[:n]...)
+		if err == io.EOF {
+			if n > 0 {
+				continue
+			}
+			fi, err := f.f.Stat()
+			if err != nil {
+				return nil, err
+			}
+			if fi.Size() < f.offset+int64(len(f.buf)) {
+				if _, err := f.f.Seek(0, io.SeekStart); err != nil {
+					return nil, err
+				}
+				f.offset, f.buf = 0, nil
+				continue
+			}
+			if f.gone && len(f.buf) > 0 {
+				return f.emit(len(f.buf)), nil
+			}
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// emit the first n bytes of buf as a record.
+func (f *tailedFile) emit(n int) []byte {
+	rec := make([]byte, 0, n+1)
+	rec = append(rec, f.buf[:n]...)
+	if rec[len(rec)-1] != '\n' {
+		rec = append(rec, '\n')
+	}
+	f.buf = f.buf[n:]
+	f.offset += int64(n)
+	return rec
+}
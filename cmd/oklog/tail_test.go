@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestTailer(t *testing.T) {
+	var (
+		dir        = t.TempDir()
+		path       = filepath.Join(dir, "app.log")
+		checkpoint = filepath.Join(dir, "checkpoints.json")
+		inputs     = []fileInput{{pattern: filepath.Join(dir, "*.log"), prefix: "app "}}
+	)
+	appendFile := func(path, s string) {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.WriteString(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := func() *tailer {
+		label := func(prefix string, line []byte) []byte { return append([]byte(prefix), line...) }
+		tl, err := newTailer(inputs, checkpoint, 5*time.Millisecond, 1024, label, log.NewNopLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tl
+	}
+	expect := func(tl *tailer, want ...string) {
+		t.Helper()
+		for _, want := range want {
+			rec, err := tl.read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if have := string(rec); want != have {
+				t.Fatalf("want %q, have %q", want, have)
+			}
+		}
+	}
+
+	// Complete lines are read; a partial one waits for its newline.
+	appendFile(path, "one\ntwo\nthr")
+	tl := start()
+	expect(tl, "app one\n", "app two\n")
+	appendFile(path, "ee\n")
+	expect(tl, "app three\n")
+
+	// Renamed away, the file is read to the end, and its replacement from
+	// the start.
+	appendFile(path, "four\nfive")
+	if err := os.Rename(path, filepath.Join(dir, "app.log.1")); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(path, "six\n")
+	have := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		rec, err := tl.read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		have[string(rec)] = true // the files may interleave
+	}
+	for _, want := range []string{"app four\n", "app five\n", "app six\n"} {
+		if !have[want] {
+			t.Errorf("want %q, have %v", want, have)
+		}
+	}
+
+	// Truncated, the file is read from the start.
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond) // noticed before it grows back
+	appendFile(path, "seven\n")
+	expect(tl, "app seven\n")
+
+	// After a restart, tailing resumes after the last record committed.
+	// Records read but not committed are read again.
+	appendFile(path, "eight\nnine\n")
+	expect(tl, "app eight\n", "app nine\n")
+	tl.commit(8) // all but nine
+	if err := tl.close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tl.read(); err != io.EOF {
+		t.Fatalf("want EOF once closed, have %v", err)
+	}
+	tl = start()
+	defer tl.close()
+	appendFile(path, "ten\n")
+	expect(tl, "app nine\n", "app ten\n")
+}
+
+func TestParseFileInput(t *testing.T) {
+	for _, testcase := range []struct {
+		input string
+		want  fileInput
+	}{
+		{"/var/log/*.log", fileInput{pattern: "/var/log/*.log"}},
+		{"/var/log/nginx/*.log nginx", fileInput{pattern: "/var/log/nginx/*.log", prefix: "nginx "}},
+		{"/var/log/a.log a env=prod ", fileInput{pattern: "/var/log/a.log", prefix: "a env=prod "}},
+	} {
+		have, err := parseFileInput(testcase.input)
+		if err != nil {
+			t.Errorf("%q: %v", testcase.input, err)
+			continue
+		}
+		if have != testcase.want {
+			t.Errorf("%q: want %+v, have %+v", testcase.input, testcase.want, have)
+		}
+	}
+	if _, err := parseFileInput("/var/log/[.log"); err == nil {
+		t.Errorf("want error for bad pattern, have none")
+	}
+}
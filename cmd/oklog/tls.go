@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// newServerTLSConfig returns a TLS config for the ingest listeners, or nil if
+// no certificate is given. If clientCAFile is nonempty, clients must present a
+// certificate signed by one of the CAs in that bundle.
+func newServerTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		if clientCAFile != "" {
+			return nil, errors.New("client CA given without server certificate and key")
+		}
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading server certificate")
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile != "" {
+		pool, err := loadCertPool(clientCAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "loading client CA")
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// newClientTLSConfig returns a TLS config for dialing ingesters. The CA bundle
+// is optional; without it, the system roots are used. The certificate and key
+// are optional too, but must be given together.
+func newClientTLSConfig(certFile, keyFile, caFile, serverName string) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "loading client certificate")
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "loading CA")
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// tlsDialer returns a dialer of TLS connections to ingesters, with config.
+func tlsDialer(config *tls.Config) func(network, address string) (net.Conn, error) {
+	return func(network, address string) (net.Conn, error) {
+		return tls.Dial(network, address, config)
+	}
+}
+
+func loadCertPool(filename string) (*x509.CertPool, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(buf) {
+		return nil, errors.Errorf("%s: no certificates found", filename)
+	}
+	return pool, nil
+}
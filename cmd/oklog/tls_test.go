@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewServerTLSConfig(t *testing.T) {
+	config, err := newServerTLSConfig("", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config != nil {
+		t.Errorf("want nil config without certificate, have %+v", config)
+	}
+
+	if _, err := newServerTLSConfig("", "", "ca.pem"); err == nil {
+		t.Errorf("want error for client CA without certificate, have none")
+	}
+}
+
+func TestTLSHandshake(t *testing.T) {
+	dir := t.TempDir()
+	file := func(name string) string { return filepath.Join(dir, name) }
+	ca, caKey := newTestCert(t, dir, "ca", nil, nil)
+	newTestCert(t, dir, "server", ca, caKey)
+	newTestCert(t, dir, "client", ca, caKey)
+
+	for _, testcase := range []struct {
+		name     string
+		clientCA string // for the server to verify clients with
+		cert     string // of the client, if any
+		ok       bool
+	}{
+		{"TLS", "", "", true},
+		{"mutual TLS", "ca", "client", true},
+		{"mutual TLS without client certificate", "ca", "", false},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			var clientCAFile, certFile, keyFile string
+			if testcase.clientCA != "" {
+				clientCAFile = file(testcase.clientCA + ".pem")
+			}
+			if testcase.cert != "" {
+				certFile, keyFile = file(testcase.cert+".pem"), file(testcase.cert+".key")
+			}
+			serverConfig, err := newServerTLSConfig(file("server.pem"), file("server.key"), clientCAFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			clientConfig, err := newClientTLSConfig(certFile, keyFile, file("ca.pem"), "localhost")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ln = tls.NewListener(ln, serverConfig)
+			defer ln.Close()
+			errc := make(chan error, 1)
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					errc <- err
+					return
+				}
+				defer conn.Close()
+				if err := conn.(*tls.Conn).Handshake(); err != nil {
+					errc <- err
+					return
+				}
+				_, err = io.WriteString(conn, "ok\n")
+				errc <- err
+			}()
+
+			conn, err := tlsDialer(clientConfig)("tcp", ln.Addr().String())
+			if err == nil {
+				defer conn.Close()
+				// With TLS 1.3, the client learns it was rejected on read.
+				conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+				_, err = io.ReadFull(conn, make([]byte, 3))
+			}
+			serverErr := <-errc
+			switch {
+			case testcase.ok && (err != nil || serverErr != nil):
+				t.Errorf("want handshake, have client error %v, server error %v", err, serverErr)
+			case !testcase.ok && (err == nil || serverErr == nil):
+				t.Errorf("want rejection, have client error %v, server error %v", err, serverErr)
+			}
+		})
+	}
+}
+
+// newTestCert writes a certificate for name, and its key, to dir, as
+// name.pem and name.key. It's self-signed, as a CA, if parent is nil.
+func newTestCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for filename, block := range map[string]*pem.Block{
+		name + ".pem": {Type: "CERTIFICATE", Bytes: der},
+		name + ".key": {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, filename), pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
@@ -8,6 +8,8 @@ require (
 	github.com/djherbis/buffer v0.0.0-20150721040419-4972e2bf4a27
 	github.com/djherbis/nio v2.0.3+incompatible
 	github.com/go-kit/kit v0.9.0
+	github.com/go-logfmt/logfmt v0.4.0
+	github.com/golang/snappy v0.0.4
 	github.com/google/btree v1.0.0
 	github.com/hashicorp/go-immutable-radix v1.3.0 // indirect
 	github.com/hashicorp/go-msgpack v0.5.5 // indirect
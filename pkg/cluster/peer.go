@@ -2,8 +2,8 @@
 //
 // Ingest and store instances join the same cluster and know about each other.
 // Store instances consume segments from each ingest instance, and broadcast
-// queries to each store instance. In the future, ingest instances will share
-// load information to potentially refuse connections and balance writes.
+// queries to each store instance. Ingest instances share load information, so
+// overloaded ingesters can refuse connections and balance writes.
 package cluster
 
 import (
@@ -40,6 +40,10 @@ const (
 
 	// PeerTypeIngestStore serves both ingest and store APIs.
 	PeerTypeIngestStore = "ingeststore"
+
+	// PeerTypeForward serves nothing to other peers. Forwarders join the
+	// cluster only to discover ingesters.
+	PeerTypeForward = "forward"
 )
 
 // NewPeer creates or joins a cluster with the existing peers.
@@ -116,8 +120,57 @@ func (p *Peer) Name() string {
 }
 
 // ClusterSize returns the total size of the cluster from this node's perspective.
+// Forwarders are members, but they serve nothing, so they aren't counted.
 func (p *Peer) ClusterSize() int {
-	return p.ml.NumMembers()
+	return p.ml.NumMembers() - p.d.forwarders()
+}
+
+// Load describes how busy an ingest peer is.
+type Load struct {
+	Connections    int       `json:"connections"`
+	BytesPerSecond float64   `json:"bytes_per_second"`
+	Shedding       bool      `json:"shedding"`
+	LogBytes       int64     `json:"log_bytes"`
+	DiskFull       bool      `json:"disk_full"`
+	Draining       bool      `json:"draining"`
+	Time           time.Time `json:"time"`
+}
+
+// SetLoad records the load of this node, and gossips it to the cluster.
+func (p *Peer) SetLoad(l Load) {
+	p.d.setLoad(p.Name(), l)
+}
+
+// IngestPorts are the ports of an ingest peer's listeners, on its API host.
+type IngestPorts struct {
+	Fast    int `json:"fast"`
+	Durable int `json:"durable"`
+	Bulk    int `json:"bulk"`
+}
+
+// SetIngestPorts records the ports of this node's ingest listeners, and
+// gossips them to the cluster, so forwarders can find them.
+func (p *Peer) SetIngestPorts(ports IngestPorts) {
+	p.d.setIngestPorts(p.Name(), ports)
+}
+
+// Ingester describes an ingest peer, for forwarders.
+type Ingester struct {
+	Host  string
+	Ports *IngestPorts // nil if not advertised
+	Load  *Load        // nil if not reported
+}
+
+// Ingesters returns the current ingest peers, including ingeststore peers,
+// keyed by peer name.
+func (p *Peer) Ingesters() map[string]Ingester {
+	return p.d.ingesters()
+}
+
+// Loads returns the most recent load of each peer of the given type that
+// reports one, including this node, keyed by peer name.
+func (p *Peer) Loads(t PeerType) map[string]Load {
+	return p.d.loads(t)
 }
 
 // State returns a JSON-serializable dump of cluster state.
@@ -137,14 +190,17 @@ func (p *Peer) State() map[string]interface{} {
 type delegate struct {
 	mtx    sync.RWMutex
 	bcast  *memberlist.TransmitLimitedQueue
+	name   string
 	data   map[string]peerInfo
 	logger log.Logger
 }
 
 type peerInfo struct {
-	Type    PeerType `json:"type"`
-	APIAddr string   `json:"api_addr"`
-	APIPort int      `json:"api_port"`
+	Type    PeerType     `json:"type"`
+	APIAddr string       `json:"api_addr"`
+	APIPort int          `json:"api_port"`
+	Load    *Load        `json:"load,omitempty"`
+	Ingest  *IngestPorts `json:"ingest,omitempty"`
 }
 
 func newDelegate(logger log.Logger) *delegate {
@@ -166,23 +222,102 @@ func (d *delegate) init(myName string, myType PeerType, apiAddr string, apiPort
 		NumNodes:       numNodes,
 		RetransmitMult: 3,
 	}
-	d.data[myName] = peerInfo{myType, apiAddr, apiPort}
+	d.name = myName
+	d.data[myName] = peerInfo{myType, apiAddr, apiPort, nil, nil}
+}
+
+func (d *delegate) setLoad(name string, l Load) {
+	d.update(name, func(info *peerInfo) { info.Load = &l })
+}
+
+func (d *delegate) setIngestPorts(name string, ports IngestPorts) {
+	d.update(name, func(info *peerInfo) { info.Ingest = &ports })
+}
+
+// update our own data, and gossip all of it.
+func (d *delegate) update(name string, f func(*peerInfo)) {
+	d.mtx.Lock()
+	info := d.data[name]
+	f(&info)
+	d.data[name] = info
+	buf, err := json.Marshal(map[string]peerInfo{name: info})
+	d.mtx.Unlock()
+	if err != nil {
+		panic(err)
+	}
+	d.bcast.QueueBroadcast(peerBroadcast{name, buf})
+}
+
+func (d *delegate) ingesters() map[string]Ingester {
+	res := map[string]Ingester{}
+	for name, info := range d.state() {
+		if !info.Type.matches(PeerTypeIngest) {
+			continue
+		}
+		res[name] = Ingester{Host: info.APIAddr, Ports: info.Ingest, Load: info.Load}
+	}
+	return res
+}
+
+func (d *delegate) forwarders() (n int) {
+	for _, info := range d.state() {
+		if info.Type == PeerTypeForward {
+			n++
+		}
+	}
+	return n
+}
+
+func (d *delegate) loads(t PeerType) map[string]Load {
+	res := map[string]Load{}
+	for name, info := range d.state() {
+		if info.Load == nil || !info.Type.matches(t) {
+			continue
+		}
+		res[name] = *info.Load
+	}
+	return res
+}
+
+// merge updates our view of the cluster with data from other peers.
+// Our own data is authoritative, and newer loads win over older ones,
+// as gossip may arrive out of order. Ingest ports, once known, don't change.
+// Callers must hold the lock.
+func (d *delegate) merge(data map[string]peerInfo) {
+	for k, v := range data {
+		if k == d.name {
+			continue
+		}
+		prev, ok := d.data[k]
+		if ok && prev.Load != nil && (v.Load == nil || v.Load.Time.Before(prev.Load.Time)) {
+			v.Load = prev.Load
+		}
+		if ok && v.Ingest == nil {
+			v.Ingest = prev.Ingest
+		}
+		d.data[k] = v
+	}
 }
 
 func (d *delegate) current(t PeerType) (res []string) {
 	for _, info := range d.state() {
-		var (
-			matchIngest      = t == PeerTypeIngest && (info.Type == PeerTypeIngest || info.Type == PeerTypeIngestStore)
-			matchStore       = t == PeerTypeStore && (info.Type == PeerTypeStore || info.Type == PeerTypeIngestStore)
-			matchIngestStore = t == PeerTypeIngestStore && info.Type == PeerTypeIngestStore
-		)
-		if matchIngest || matchStore || matchIngestStore {
+		if info.Type.matches(t) {
 			res = append(res, net.JoinHostPort(info.APIAddr, strconv.Itoa(info.APIPort)))
 		}
 	}
 	return res
 }
 
+// matches returns true if a peer of type pt serves the API of type t.
+func (pt PeerType) matches(t PeerType) bool {
+	var (
+		matchIngest      = t == PeerTypeIngest && (pt == PeerTypeIngest || pt == PeerTypeIngestStore)
+		matchStore       = t == PeerTypeStore && (pt == PeerTypeStore || pt == PeerTypeIngestStore)
+		matchIngestStore = t == PeerTypeIngestStore && pt == PeerTypeIngestStore
+	)
+	return matchIngest || matchStore || matchIngestStore
+}
+
 func (d *delegate) state() map[string]peerInfo {
 	d.mtx.RLock()
 	defer d.mtx.RUnlock()
@@ -219,10 +354,7 @@ func (d *delegate) NotifyMsg(b []byte) {
 	}
 	d.mtx.Lock()
 	defer d.mtx.Unlock()
-	for k, v := range data {
-		// Removing data is handled by NotifyLeave
-		d.data[k] = v
-	}
+	d.merge(data) // removing data is handled by NotifyLeave
 }
 
 // GetBroadcasts is called when user data messages can be broadcast.
@@ -273,9 +405,7 @@ func (d *delegate) MergeRemoteState(buf []byte, join bool) {
 	}
 	d.mtx.Lock()
 	defer d.mtx.Unlock()
-	for k, v := range data {
-		d.data[k] = v
-	}
+	d.merge(data)
 }
 
 // NotifyJoin is invoked when a node is detected to have joined.
@@ -301,3 +431,25 @@ func (d *delegate) NotifyLeave(n *memberlist.Node) {
 	defer d.mtx.Unlock()
 	delete(d.data, n.Name)
 }
+
+// peerBroadcast is a gossip message carrying the data of a single peer.
+// Implements memberlist.Broadcast.
+type peerBroadcast struct {
+	name string
+	msg  []byte
+}
+
+// Invalidates returns true if the other broadcast is about the same peer,
+// as the more recent broadcast supersedes it.
+func (b peerBroadcast) Invalidates(other memberlist.Broadcast) bool {
+	o, ok := other.(peerBroadcast)
+	return ok && o.name == b.name
+}
+
+// Message returns the broadcast payload.
+func (b peerBroadcast) Message() []byte {
+	return b.msg
+}
+
+// Finished is invoked when the broadcast is no longer needed.
+func (b peerBroadcast) Finished() {}
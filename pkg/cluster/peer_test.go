@@ -0,0 +1,81 @@
+package cluster
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestDelegateLoads(t *testing.T) {
+	d := newDelegate(log.NewNopLogger())
+	d.init("self", PeerTypeIngest, "127.0.0.1", 7650, func() int { return 3 })
+
+	var (
+		now   = time.Now()
+		older = now.Add(-time.Second)
+	)
+	d.setLoad("self", Load{Connections: 1, Time: now})
+	d.merge(map[string]peerInfo{
+		"self":  {PeerTypeIngest, "127.0.0.1", 7650, &Load{Connections: 99, Time: now}, nil},
+		"other": {PeerTypeIngestStore, "127.0.0.2", 7650, &Load{Connections: 2, Time: now}, nil},
+		"store": {PeerTypeStore, "127.0.0.3", 7650, nil, nil},
+	})
+
+	// Stale gossip shouldn't clobber newer load.
+	d.merge(map[string]peerInfo{
+		"other": {PeerTypeIngestStore, "127.0.0.2", 7650, &Load{Connections: 7, Time: older}, nil},
+	})
+
+	loads := d.loads(PeerTypeIngest)
+	if want, have := 2, len(loads); want != have {
+		t.Fatalf("want %d loads, have %d (%v)", want, have, loads)
+	}
+	if want, have := 1, loads["self"].Connections; want != have {
+		t.Errorf("self: want %d, have %d", want, have)
+	}
+	if want, have := 2, loads["other"].Connections; want != have {
+		t.Errorf("other: want %d, have %d", want, have)
+	}
+	if want, have := 1, len(d.loads(PeerTypeStore)); want != have { // just the ingeststore
+		t.Errorf("store: want %d loads, have %d", want, have)
+	}
+}
+
+func TestDelegateIngesters(t *testing.T) {
+	d := newDelegate(log.NewNopLogger())
+	d.init("self", PeerTypeForward, "127.0.0.1", 0, func() int { return 4 })
+
+	ports := &IngestPorts{Fast: 7651, Durable: 7652, Bulk: 7653}
+	d.merge(map[string]peerInfo{
+		"ingest":      {PeerTypeIngest, "127.0.0.2", 7650, nil, ports},
+		"ingeststore": {PeerTypeIngestStore, "127.0.0.3", 7650, &Load{Draining: true}, nil},
+		"store":       {PeerTypeStore, "127.0.0.4", 7650, nil, nil},
+	})
+
+	// Gossip without ports, e.g. sent before they were set, keeps them.
+	d.merge(map[string]peerInfo{
+		"ingest": {PeerTypeIngest, "127.0.0.2", 7650, &Load{Connections: 1}, nil},
+	})
+
+	ingesters := d.ingesters()
+	if want, have := 2, len(ingesters); want != have {
+		t.Fatalf("want %d ingesters, have %d (%v)", want, have, ingesters)
+	}
+	if i := ingesters["ingest"]; i.Host != "127.0.0.2" || i.Ports == nil || *i.Ports != *ports || i.Load == nil {
+		t.Errorf("ingest: unexpected %+v", i)
+	}
+	if i := ingesters["ingeststore"]; i.Ports != nil || i.Load == nil || !i.Load.Draining {
+		t.Errorf("ingeststore: unexpected %+v", i)
+	}
+	for _, pt := range []PeerType{PeerTypeIngest, PeerTypeStore, PeerTypeIngestStore} {
+		for _, addr := range d.current(pt) {
+			if addr == "127.0.0.1:0" {
+				t.Errorf("%s: forwarder listed", pt)
+			}
+		}
+	}
+	if want, have := 1, d.forwarders(); want != have {
+		t.Errorf("want %d forwarders, have %d", want, have)
+	}
+}
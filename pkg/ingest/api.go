@@ -7,10 +7,13 @@ import (
 	"io"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/pborman/uuid"
 	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/oklog/oklog/pkg/record"
 )
 
 // These are the ingest API URL paths.
@@ -19,6 +22,10 @@ const (
 	APIPathRead         = "/read"
 	APIPathCommit       = "/commit"
 	APIPathFailed       = "/failed"
+	APIPathPush         = "/push"
+	APIPathConnections  = "/connections"
+	APIPathDisconnect   = "/disconnect"
+	APIPathDrain        = "/drain"
 	APIPathSegmentState = "/_segmentstate"
 	APIPathClusterState = "/_clusterstate"
 )
@@ -27,6 +34,13 @@ const (
 type API struct {
 	peer              ClusterPeer
 	log               Log
+	writer            *Writer
+	rfac              record.ReaderFactory
+	topicRfac         func(topic []byte) record.ReaderFactory
+	pushMtx           sync.Mutex // serializes IDs and writes, so they're sorted
+	idGen             IDGenerator
+	conns             *Connections
+	drainer           *Drainer
 	timeout           time.Duration
 	pending           map[string]pendingSegment
 	action            chan func()
@@ -48,10 +62,21 @@ type ClusterPeer interface {
 	State() map[string]interface{}
 }
 
-// NewAPI returns a usable ingest API.
+// NewAPI returns a usable ingest API. Records pushed via HTTP are read with
+// rfac, or with the ReaderFactory from topicRfac for the topic parameter,
+// identified by a single IDGenerator from idfac, and written to w, which
+// remains owned by the caller. The active connections in conns are listed, and
+// may be disconnected, via the API. The API starts, and reports on, drains
+// via the drainer, and refuses pushes while draining.
 func NewAPI(
 	peer ClusterPeer,
 	log Log,
+	w *Writer,
+	rfac record.ReaderFactory,
+	topicRfac func(topic []byte) record.ReaderFactory,
+	idfac IDGeneratorFactory,
+	conns *Connections,
+	drainer *Drainer,
 	pendingSegmentTimeout time.Duration,
 	failedSegments, committedSegments, committedBytes prometheus.Counter,
 	duration *prometheus.HistogramVec,
@@ -59,6 +84,12 @@ func NewAPI(
 	a := &API{
 		peer:              peer,
 		log:               log,
+		writer:            w,
+		rfac:              rfac,
+		topicRfac:         topicRfac,
+		idGen:             idfac(),
+		conns:             conns,
+		drainer:           drainer,
 		timeout:           pendingSegmentTimeout,
 		pending:           map[string]pendingSegment{},
 		action:            make(chan func()),
@@ -94,6 +125,16 @@ func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		a.handleCommit(w, r)
 	case method == "POST" && path == APIPathFailed:
 		a.handleFailed(w, r)
+	case method == "POST" && path == APIPathPush:
+		a.handlePush(w, r)
+	case method == "GET" && path == APIPathConnections:
+		a.handleConnections(w, r)
+	case method == "POST" && path == APIPathDisconnect:
+		a.handleDisconnect(w, r)
+	case method == "GET" && path == APIPathDrain:
+		a.handleDrainStatus(w, r)
+	case method == "POST" && path == APIPathDrain:
+		a.handleDrain(w, r)
 	case method == "GET" && path == APIPathSegmentState:
 		a.handleSegmentStatus(w, r)
 	case method == "GET" && path == APIPathClusterState:
@@ -153,14 +194,19 @@ func (a *API) clean(now time.Time) {
 	}
 }
 
+// handleNext returns the ID of the oldest flushed segment, which the client
+// should then read. With one or more topic parameters, only segments of those
+// topics are considered, so consumers can prioritize topics during a backlog;
+// this requires ingesters to write segments per topic.
 func (a *API) handleNext(w http.ResponseWriter, r *http.Request) {
 	var (
+		topics     = r.URL.Query()["topic"]
 		notFound   = make(chan struct{})
 		otherError = make(chan error)
 		nextID     = make(chan string)
 	)
 	a.action <- func() {
-		s, err := a.log.Oldest()
+		s, err := a.log.Oldest(topics...)
 		if err == ErrNoSegmentsAvailable {
 			close(notFound)
 			return
@@ -286,6 +332,196 @@ func (a *API) handleFailed(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// These are the write modes of the push endpoint.
+const (
+	pushModeFast    = "fast"
+	pushModeDurable = "durable"
+)
+
+// pushMaxSize is the largest request body the push endpoint accepts, as it's
+// read in full before any of it is written.
+const pushMaxSize = BulkMaxSize
+
+// handlePush writes newline-delimited records from the request body, and
+// responds with the ID assigned to each, one per line. The optional topic
+// parameter overrides the topic mode of the node. With format=ndjson, or the
+// corresponding content type, every line must be a JSON value, and the topic
+// parameter is required, as the lines carry none. With mode=durable, the
+// response is sent only once the records are synced. The body is validated
+// before any of it is written, so rejected requests can be retried.
+func (a *API) handlePush(w http.ResponseWriter, r *http.Request) {
+	var (
+		query  = r.URL.Query()
+		topic  = query.Get("topic")
+		mode   = query.Get("mode")
+		ndjson = query.Get("format") == "ndjson" || r.Header.Get("Content-Type") == "application/x-ndjson"
+		rfac   = a.rfac
+	)
+	if a.drainer.isDraining() {
+		http.Error(w, "ingester is draining", http.StatusServiceUnavailable)
+		return
+	}
+	if ndjson && topic == "" {
+		http.Error(w, "format=ndjson requires a topic parameter", http.StatusBadRequest)
+		return
+	}
+	if topic != "" {
+		if !record.IsValidTopic([]byte(topic)) {
+			http.Error(w, fmt.Sprintf("topic name %q invalid", topic), http.StatusBadRequest)
+			return
+		}
+		rfac = a.topicRfac([]byte(topic))
+	}
+	switch mode {
+	case "", pushModeFast, pushModeDurable:
+	default:
+		http.Error(w, fmt.Sprintf("mode %q invalid, must be %q or %q", mode, pushModeFast, pushModeDurable), http.StatusBadRequest)
+		return
+	}
+
+	var (
+		read = rfac(&newlineTerminator{r: http.MaxBytesReader(w, r.Body, pushMaxSize)})
+		recs [][]byte // nil where dropped
+	)
+	defer func() {
+		// Readers may read ahead in the background, e.g. to join multiline
+		// records. Close the body, so they fail, and drain them, so they've
+		// exited before the server reuses the request.
+		r.Body.Close()
+		drain(read)
+	}()
+	for {
+		rec, err := read()
+		if err == io.EOF {
+			break
+		}
+		if err == ErrRecordDropped {
+			recs = append(recs, nil)
+			continue
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("record %d: %v; nothing written", len(recs)+1, err), http.StatusBadRequest)
+			return
+		}
+		if ndjson {
+			// Records are "topic payload\n", with the topic parameter.
+			if !json.Valid(rec[bytes.IndexByte(rec, ' ')+1:]) {
+				http.Error(w, fmt.Sprintf("record %d: invalid JSON; nothing written", len(recs)+1), http.StatusBadRequest)
+				return
+			}
+		}
+		recs = append(recs, rec)
+	}
+	ids, n, err := a.write(recs)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("after %d record(s) written: %v", n, err), http.StatusInternalServerError)
+		return
+	}
+	if mode == pushModeDurable && n > 0 {
+		if err := a.writer.Sync(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	ids.WriteTo(w)
+}
+
+// write identifies the pushed records, and writes them, returning their IDs,
+// one per line, and how many were written. Dropped records, which are nil,
+// are acked as such.
+func (a *API) write(recs [][]byte) (ids bytes.Buffer, n int, err error) {
+	a.pushMtx.Lock()
+	defer a.pushMtx.Unlock()
+	for _, rec := range recs {
+		if rec == nil {
+			fmt.Fprintln(&ids, droppedAck)
+			continue
+		}
+		id := a.idGen(rec)
+		if _, err := fmt.Fprintf(a.writer, "%s %s", id, rec); err != nil {
+			return ids, n, err
+		}
+		fmt.Fprintln(&ids, id)
+		n++
+	}
+	return ids, n, nil
+}
+
+// newlineTerminator makes sure the final record of a request body is
+// terminated with a newline, as clients often leave it off.
+type newlineTerminator struct {
+	r       io.Reader
+	last    byte
+	pending bool
+	done    bool
+}
+
+func (t *newlineTerminator) Read(p []byte) (int, error) {
+	if t.pending && len(p) > 0 {
+		p[0], t.pending, t.done = '\n', false, true
+		return 1, io.EOF
+	}
+	if t.done {
+		return 0, io.EOF
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		t.last = p[n-1]
+	}
+	if err != io.EOF {
+		return n, err
+	}
+	if t.last == 0 || t.last == '\n' {
+		t.done = true
+		return n, io.EOF
+	}
+	if n < len(p) {
+		p[n], t.done = '\n', true
+		return n + 1, io.EOF
+	}
+	t.pending = true
+	return n, nil
+}
+
+func (a *API) handleConnections(w http.ResponseWriter, r *http.Request) {
+	buf, err := json.MarshalIndent(a.conns.List(), "", "    ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(buf)
+}
+
+// handleDisconnect forcibly closes an active connection, e.g. to evict a
+// misbehaving client, or to have it reconnect to a different ingester.
+func (a *API) handleDisconnect(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if !a.conns.Disconnect(id) {
+		http.NotFound(w, r)
+		return
+	}
+	fmt.Fprint(w, "Disconnect OK")
+}
+
+// handleDrain starts draining the ingester, and returns its progress, which
+// may be polled with GET.
+func (a *API) handleDrain(w http.ResponseWriter, r *http.Request) {
+	a.drainer.Start()
+	a.handleDrainStatus(w, r)
+}
+
+func (a *API) handleDrainStatus(w http.ResponseWriter, r *http.Request) {
+	buf, err := json.MarshalIndent(a.drainer.Status(), "", "    ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(buf)
+}
+
 func (a *API) handleSegmentStatus(w http.ResponseWriter, r *http.Request) {
 	status := make(chan string)
 	a.action <- func() {
@@ -0,0 +1,91 @@
+package ingest
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/oklog/oklog/pkg/fs"
+	"github.com/oklog/oklog/pkg/record"
+)
+
+func TestAPIPush(t *testing.T) {
+	t.Parallel()
+
+	log, err := NewFileLog(fs.NewVirtualFilesystem(), "/", 0, prometheus.NewCounter(prometheus.CounterOpts{}), prometheus.NewCounter(prometheus.CounterOpts{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewWriter(log, testWriterConfig(time.Hour, 1024*1024, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	topicRfac := func(topic []byte) record.ReaderFactory { // wrapped like rfac would be
+		return record.LimitReaderFactory(record.StaticReaderFactory(topic), 16, record.OversizeReject, false, prometheus.NewCounter(prometheus.CounterOpts{}))
+	}
+	api := NewAPI(
+		nil, log, w, record.NewDynamicReader, topicRfac, NewIDGenerator, NewConnections(), NewDrainer(log, NewConnections()), time.Minute,
+		prometheus.NewCounter(prometheus.CounterOpts{}),
+		prometheus.NewCounter(prometheus.CounterOpts{}),
+		prometheus.NewCounter(prometheus.CounterOpts{}),
+		prometheus.NewHistogramVec(prometheus.HistogramOpts{}, []string{"method", "path", "status_code"}),
+	)
+	defer api.Stop()
+
+	for _, testcase := range []struct {
+		query string
+		body  string
+		code  int
+		ids   int
+	}{
+		{"", "a one\nb two", http.StatusOK, 2},
+		{"?topic=c&mode=durable", "three\n", http.StatusOK, 1},
+		{"?topic=d&format=ndjson", `{"four":4}` + "\n", http.StatusOK, 1},
+		{"?topic=abcde", "x\ny\n", http.StatusOK, 2}, // records don't share the topic's buffer
+		{"?topic=d&format=ndjson", "not json\n", http.StatusBadRequest, 0},
+		{"?topic=d&format=ndjson", `{"ok":true}` + "\n" + "not json\n", http.StatusBadRequest, 0},
+		{"?format=ndjson", `{"five":5}` + "\n", http.StatusBadRequest, 0},
+		{"?topic=~e", "five\n", http.StatusBadRequest, 0},
+		{"?topic=e", "far too long for the limit\n", http.StatusBadRequest, 0},
+		{"?mode=eventually", "a six\n", http.StatusBadRequest, 0},
+		{"", "no-topic\n", http.StatusBadRequest, 0},
+	} {
+		req := httptest.NewRequest("POST", APIPathPush+testcase.query, strings.NewReader(testcase.body))
+		rec := httptest.NewRecorder()
+		api.ServeHTTP(rec, req)
+		if want, have := testcase.code, rec.Code; want != have {
+			t.Errorf("%s %q: code: want %d, have %d (%s)", testcase.query, testcase.body, want, have, strings.TrimSpace(rec.Body.String()))
+			continue
+		}
+		if testcase.code != http.StatusOK {
+			continue
+		}
+		if want, have := testcase.ids, len(strings.Fields(rec.Body.String())); want != have {
+			t.Errorf("%s %q: IDs: want %d, have %d", testcase.query, testcase.body, want, have)
+		}
+	}
+
+	// Flush and check what was written.
+	w.Stop()
+	s, err := log.Oldest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadAll(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var have []string
+	for _, line := range strings.Split(strings.TrimSpace(string(buf)), "\n") {
+		have = append(have, strings.SplitN(line, " ", 2)[1]) // strip ULID
+	}
+	want := []string{"a one", "b two", "c three", `d {"four":4}`, "abcde x", "abcde y"}
+	if strings.Join(want, "\n") != strings.Join(have, "\n") {
+		t.Errorf("records: want %q, have %q", want, have)
+	}
+}
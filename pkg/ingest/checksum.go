@@ -0,0 +1,114 @@
+package ingest
+
+import (
+	"bufio"
+	"encoding/hex"
+	"hash/crc32"
+	"io"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Each record in a segment file is prefixed with the CRC-32C of the record,
+// in hex, and a space. Records are checked, and the prefix stripped, as they
+// are read back, so consumers never see it. Records without a prefix, from
+// older versions, are passed through unchecked, unless the segment has
+// checksummed records, in which case the prefix must have been damaged.
+const checksumLen = 8
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// appendChecksummed appends the record, with its checksum, to dst.
+// The record must be terminated by a newline.
+func appendChecksummed(dst, record []byte) []byte {
+	var sum [4]byte
+	c := crc32.Checksum(record, crc32c)
+	sum[0], sum[1], sum[2], sum[3] = byte(c>>24), byte(c>>16), byte(c>>8), byte(c)
+	var prefix [checksumLen + 1]byte
+	hex.Encode(prefix[:checksumLen], sum[:])
+	prefix[checksumLen] = ' '
+	dst = append(dst, prefix[:]...)
+	return append(dst, record...)
+}
+
+// verifyLine returns the record in the line read from a segment file, and
+// false if it's damaged. Torn writes leave a final line without a newline.
+// Checksummed is set once a line has a valid checksum; after that, lines
+// without one are damaged, too.
+func verifyLine(line []byte, checksummed *bool) ([]byte, bool) {
+	if len(line) <= 0 || line[len(line)-1] != '\n' {
+		return nil, false
+	}
+	if len(line) <= checksumLen || line[checksumLen] != ' ' {
+		return line, !*checksummed // no checksum; older records start with a ULID
+	}
+	var sum [4]byte
+	if _, err := hex.Decode(sum[:], line[:checksumLen]); err != nil {
+		return nil, false
+	}
+	record := line[checksumLen+1:]
+	c := crc32.Checksum(record, crc32c)
+	if sum[0] != byte(c>>24) || sum[1] != byte(c>>16) || sum[2] != byte(c>>8) || sum[3] != byte(c) {
+		return nil, false
+	}
+	*checksummed = true
+	return record, true
+}
+
+// verifyingReader reads the records from a segment file, skipping and
+// counting damaged ones.
+type verifyingReader struct {
+	br          *bufio.Reader
+	buf         []byte
+	checksummed bool
+	corrupt     prometheus.Counter
+}
+
+func newVerifyingReader(r io.Reader, corrupt prometheus.Counter) *verifyingReader {
+	return &verifyingReader{br: bufio.NewReader(r), corrupt: corrupt}
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	for len(r.buf) <= 0 {
+		line, err := r.br.ReadBytes('\n')
+		if len(line) > 0 {
+			if record, ok := verifyLine(line, &r.checksummed); ok {
+				r.buf = record
+			} else {
+				r.corrupt.Inc()
+			}
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// verifySegment reads the segment file from r, and returns the length of the
+// lines before the first damaged record, and the number of records from it on.
+func verifySegment(r io.Reader) (valid int64, damaged int, err error) {
+	var (
+		br          = bufio.NewReader(r)
+		checksummed bool
+	)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			if _, ok := verifyLine(line, &checksummed); !ok || damaged > 0 {
+				damaged++
+			} else {
+				valid += int64(len(line))
+			}
+		}
+		if err == io.EOF {
+			return valid, damaged, nil
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package ingest
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/oklog/oklog/pkg/fs"
+)
+
+func TestChecksummedSegment(t *testing.T) {
+	t.Parallel()
+
+	f, err := fs.NewVirtualFilesystem().Create("segment" + extActive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &fileWriteSegment{f: f}
+	for _, p := range []string{
+		"01BB6RQR190000000000000000 t one\n",
+		"01BB6RQR190000000000000001 t tw", // partial writes are joined
+		"o\n01BB6RQR190000000000000002 t three\n",
+	} {
+		if n, err := w.Write([]byte(p)); err != nil || n != len(p) {
+			t.Fatalf("Write(%q): %d, %v", p, n, err)
+		}
+	}
+
+	// Damage the second record on disk.
+	written, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.SplitAfter(written, []byte("\n"))
+	if want, have := 4, len(lines); want != have { // including the empty remainder
+		t.Fatalf("want %d lines, have %d: %q", want, have, written)
+	}
+	lines[1] = bytes.Replace(lines[1], []byte("two"), []byte("TWO"), 1)
+
+	var (
+		corrupt = prometheus.NewCounter(prometheus.CounterOpts{})
+		r       = newVerifyingReader(bytes.NewReader(bytes.Join(lines, nil)), corrupt)
+	)
+	read, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := "01BB6RQR190000000000000000 t one\n01BB6RQR190000000000000002 t three\n", string(read); want != have {
+		t.Errorf("want %q, have %q", want, have)
+	}
+	if want, have := 1.0, testutil.ToFloat64(corrupt); want != have {
+		t.Errorf("corrupt records: want %v, have %v", want, have)
+	}
+}
@@ -1,15 +1,18 @@
 package ingest
 
 import (
+	"bufio"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"net"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/golang/snappy"
 	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/oklog/oklog/pkg/record"
@@ -17,58 +20,105 @@ import (
 )
 
 // HandleConnections passes each connection from the listener to the connection handler.
+// Connections are tracked in conns, under the handler name, e.g. fast.
+// Records redelivered by producers are dropped by dedup, which may be nil.
+// Connections share one Writer, configured by writer, so the syncs of durable
+// connections are grouped across them.
+// Clients requesting any of the unsupported hello options are disconnected,
+// e.g. acks, if rfac may split a line into several records.
 // Terminate the function by closing the listener.
 func HandleConnections(
 	ln net.Listener,
 	h ConnectionHandler,
+	name string,
 	rfac record.ReaderFactory,
+	idfac IDGeneratorFactory,
+	conns *Connections,
+	dedup *Deduplicator,
+	unsupported []string,
 	log Log,
-	segmentFlushAge time.Duration,
-	segmentFlushSize int,
+	writer WriterConfig,
 	connectedClients prometheus.Gauge,
-	bytes, records, syncs prometheus.Counter,
-	segmentAge, segmentSize prometheus.Histogram,
 ) error {
+	// Create the writer shared by every connection.
+	// It's important that it be closed, after they're all terminated.
+	w, err := NewWriter(log, writer)
+	if err != nil {
+		return err
+	}
+	defer w.Stop() // make sure it's flushed
+
 	// We shouldn't return until all connections are terminated.
 	m := newConnectionManager()
 	defer m.shutdown()
 
 	for {
 		// Accept a connection.
-		conn, err := ln.Accept()
+		c, err := ln.Accept()
 		if err != nil {
 			return err
 		}
 
-		// Create a new writer for this connection.
-		// It's important that it be closed.
-		w, err := NewWriter(log, segmentFlushAge, segmentFlushSize, bytes, records, syncs, segmentAge, segmentSize)
-		if err != nil {
-			return err
-		}
-
-		// Create a new logical clock for the stream and ID generator for this connection.
-		clock := newStreamClock()
-		idGen := func() string { return ulid.MustNew(ulid.Now(), clock).String() }
+		// Create a new ID generator for this connection.
+		idGen := idfac()
 
 		// Register the connection in the manager, and launch the handler.
 		// The handler may exit from the client, or via manager shutdown.
-		// In either case, the writer is closed.
+		conn := conns.track(c, name)
 		m.register(conn)
 		go func() {
 			defer conn.Close()
-			h(rfac(conn), w, idGen, connectedClients)
-			w.Stop() // make sure it's flushed
-			m.remove(conn)
+			defer conns.remove(conn)
+			defer m.remove(conn)
+
+			// Clients may open with a hello, to request e.g. acks.
+			br := bufio.NewReader(conn)
+			hello, err := readHello(br)
+			if err != nil {
+				return
+			}
+			for _, option := range unsupported {
+				if hello.has(option) {
+					return
+				}
+			}
+			var ack io.Writer
+			if hello.has(HelloAck) {
+				ack = conn
+			}
+			switch codec := hello[HelloCompress]; codec {
+			case "":
+			case CompressSnappy:
+				br = bufio.NewReader(snappy.NewReader(br))
+			default:
+				return // unsupported
+			}
+			var r record.Reader
+			if producer := hello[HelloProducer]; producer != "" {
+				producer += "/" + hello[HelloEpoch]
+				r, idGen = newProducerStream(producer, br, rfac, dedup, idGen)
+			} else {
+				r = rfac(br)
+			}
+			r = conn.reader(r)
+			h(r, w, idGen, ack, connectedClients)
+
+			// Readers may read ahead in the background, e.g. to join multiline
+			// records. Close the conn, so they fail, and drain them, so they exit.
+			conn.Close()
+			drain(r)
 		}()
 	}
 }
 
 // ConnectionHandler forwards records from the net.Conn to the IngestLog.
-type ConnectionHandler func(r record.Reader, w *Writer, idGen IDGenerator, connectedClients prometheus.Gauge) error
+// If the client requested acks, ack is non-nil, and the handler should write
+// the ID of each record to it, once the record is persisted.
+type ConnectionHandler func(r record.Reader, w *Writer, idGen IDGenerator, ack io.Writer, connectedClients prometheus.Gauge) error
 
 // HandleFastWriter is a ConnectionHandler that writes records to the IngestLog.
-func HandleFastWriter(r record.Reader, w *Writer, idGen IDGenerator, connectedClients prometheus.Gauge) (err error) {
+// Acks are sent once records are written, but not synced.
+func HandleFastWriter(r record.Reader, w *Writer, idGen IDGenerator, ack io.Writer, connectedClients prometheus.Gauge) (err error) {
 	connectedClients.Inc()
 	defer connectedClients.Dec()
 
@@ -77,48 +127,204 @@ func HandleFastWriter(r record.Reader, w *Writer, idGen IDGenerator, connectedCl
 		if err == io.EOF {
 			return nil
 		}
+		if err == ErrRecordDropped {
+			if err := writeAck(ack, droppedAck); err != nil {
+				return err
+			}
+			continue
+		}
 		if err != nil {
 			return err
 		}
+		id := idGen(record)
 		// TODO(pb): short writes are possible
-		if _, err := fmt.Fprintf(w, "%s %s", idGen(), record); err != nil {
+		if _, err := fmt.Fprintf(w, "%s %s", id, record); err != nil {
+			return err
+		}
+		if err := writeAck(ack, id); err != nil {
 			return err
 		}
 	}
 }
 
 // HandleDurableWriter is a ConnectionHandler that writes records to the
-// IngestLog and syncs after each record.
-func HandleDurableWriter(r record.Reader, w *Writer, idGen IDGenerator, connectedClients prometheus.Gauge) (err error) {
+// IngestLog and syncs them before they're acked. Records are written as they
+// arrive, and acked in batches, once a Sync covers the whole batch. So while
+// one sync is in progress, the records that arrive meanwhile are batched for
+// the next, and there's at most one sync per batch rather than per record.
+// Batches are per connection, as each has its own Writer; concurrent
+// connections sync their own segments in parallel.
+func HandleDurableWriter(r record.Reader, w *Writer, idGen IDGenerator, ack io.Writer, connectedClients prometheus.Gauge) (err error) {
 	connectedClients.Inc()
 	defer connectedClients.Dec()
 
+	var (
+		ids  = make(chan string, durableBatchSize)
+		errc = make(chan error, 1)
+	)
+	go func() { errc <- ackSynced(w, ids, ack) }()
+
+	err = func() error {
+		defer close(ids)
+		for {
+			record, err := r()
+			if err == io.EOF {
+				return nil
+			}
+			id := droppedAck
+			if err != nil && err != ErrRecordDropped {
+				return err
+			}
+			if err == nil {
+				id = idGen(record)
+				// TODO(pb): short writes are possible
+				if _, err := fmt.Fprintf(w, "%s %s", id, record); err != nil {
+					return err
+				}
+			}
+			select {
+			case ids <- id:
+			case err := <-errc:
+				errc <- err // for below
+				return err
+			}
+		}
+	}()
+	if ackErr := <-errc; err == nil {
+		err = ackErr
+	}
+	return err
+}
+
+// durableBatchSize is the most records HandleDurableWriter acks per sync.
+const durableBatchSize = 1024
+
+// ackSynced acks the IDs of written records in batches, each after a Sync,
+// until ids is closed.
+func ackSynced(w *Writer, ids <-chan string, ack io.Writer) error {
+	batch := make([]string, 0, durableBatchSize)
+	for id := range ids {
+		batch = append(batch[:0], id)
+	fill:
+		for len(batch) < cap(batch) {
+			select {
+			case id, ok := <-ids:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, id)
+			default:
+				break fill
+			}
+		}
+		if err := w.Sync(); err != nil {
+			return err
+		}
+		for _, id := range batch {
+			if err := writeAck(ack, id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// HandleBulkWriter is a ConnectionHandler that writes an entire batch of
+// records to the IngestLog at once. The client writes the batch, and closes
+// its side of the connection. Only once the whole batch is read is it
+// written, and synced, so a batch cut short is never written in part. Then
+// the batch is acked as a whole, with one line counting the records written.
+// Records may be dropped, or joined, so the count needn't match the number of
+// lines the client wrote.
+//
+// Records are marked as seen by the Deduplicator before they're written, so
+// connections for bulk writes mustn't have one. Redelivered records from
+// producers are still dropped by the store, by their IDs.
+func HandleBulkWriter(r record.Reader, w *Writer, idGen IDGenerator, ack io.Writer, connectedClients prometheus.Gauge) (err error) {
+	connectedClients.Inc()
+	defer connectedClients.Dec()
+
+	var (
+		batch [][]byte
+		size  int
+	)
 	for {
 		record, err := r()
 		if err == io.EOF {
-			return nil
+			break
+		}
+		if err == ErrRecordDropped {
+			continue
 		}
 		if err != nil {
 			return err
 		}
+		id := idGen(record)
+		rec := make([]byte, 0, len(id)+1+len(record))
+		rec = append(append(append(rec, id...), ' '), record...)
+		if size += len(rec); size > BulkMaxSize {
+			return ErrBulkTooLarge
+		}
+		batch = append(batch, rec)
+	}
+
+	for _, rec := range batch {
 		// TODO(pb): short writes are possible
-		if _, err := fmt.Fprintf(w, "%s %s", idGen(), record); err != nil {
+		if _, err := w.Write(rec); err != nil {
 			return err
 		}
-		if err := w.Sync(); err != nil {
-			return err
+	}
+	if err := w.Sync(); err != nil {
+		return err
+	}
+	return writeAck(ack, strconv.Itoa(len(batch)))
+}
+
+// BulkMaxSize is the largest batch HandleBulkWriter accepts, in bytes of
+// records, including their IDs.
+const BulkMaxSize = 64 * 1024 * 1024
+
+// ErrBulkTooLarge is returned by HandleBulkWriter for batches over
+// BulkMaxSize. None of the batch is written.
+var ErrBulkTooLarge = errors.New("bulk batch too large")
+
+// drain reads from r until it fails.
+func drain(r record.Reader) {
+	for {
+		if _, err := r(); err != nil && err != ErrRecordDropped {
+			return
 		}
 	}
 }
 
-// HandleBulkWriter is a ConnectionHandler that writes an entire segment to the
-// IngestLog at once.
-func HandleBulkWriter(r record.Reader, w *Writer, idGen IDGenerator, connectedClients prometheus.Gauge) (err error) {
-	return errors.New("TODO(pb): not implemented")
+// droppedAck acknowledges records that were read, but deliberately dropped,
+// so clients counting acks stay in step.
+const droppedAck = "-"
+
+// writeAck acknowledges the record ID to the client, if it asked for acks.
+func writeAck(ack io.Writer, id string) error {
+	if ack == nil {
+		return nil
+	}
+	_, err := fmt.Fprintf(ack, "%s\n", id)
+	return err
 }
 
-// IDGenerator should return unique record identifiers, i.e. ULIDs.
-type IDGenerator func() string
+// IDGenerator should return unique record identifiers, i.e. ULIDs, for each
+// record passed to it. IDs must sort in the order they're generated.
+type IDGenerator func(record []byte) string
+
+// IDGeneratorFactory returns a new IDGenerator for each stream of records,
+// e.g. each connection.
+type IDGeneratorFactory func() IDGenerator
+
+// NewIDGenerator returns an IDGenerator that stamps records with the time they
+// arrive. It's backed by a new logical clock, which identifies the stream.
+// It is not safe to be used concurrently.
+func NewIDGenerator() IDGenerator {
+	clock := newStreamClock()
+	return func([]byte) string { return ulid.MustNew(ulid.Now(), clock).String() }
+}
 
 func newConnectionManager() *connectionManager {
 	return &connectionManager{
@@ -6,14 +6,18 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math"
 	mathrand "math/rand"
 	"net"
 	"path/filepath"
+	"strings"
 	"sync/atomic"
 	"testing"
+	"testing/iotest"
 	"time"
 
+	"github.com/golang/snappy"
 	"github.com/oklog/ulid"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -32,7 +36,7 @@ func TestHandleConnectionsCleanup(t *testing.T) {
 	// Set up a file log using our mock FS.
 	// The mock FS counts file closures.
 	fs := &mockFilesystem{}
-	log, err := NewFileLog(fs, "/")
+	log, err := NewFileLog(fs, "/", 0, prometheus.NewCounter(prometheus.CounterOpts{}), prometheus.NewCounter(prometheus.CounterOpts{}))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -42,19 +46,12 @@ func TestHandleConnectionsCleanup(t *testing.T) {
 	errc := make(chan error, 1)
 	var (
 		connectionHandler = echo(t)
-		segmentFlushAge   = time.Second
-		segmentFlushSize  = 1024 // B
+		writer            = testWriterConfig(time.Second, 1024, false)
 		connectedClients  = prometheus.NewGauge(prometheus.GaugeOpts{})
-		bytes             = prometheus.NewCounter(prometheus.CounterOpts{})
-		records           = prometheus.NewCounter(prometheus.CounterOpts{})
-		syncs             = prometheus.NewCounter(prometheus.CounterOpts{})
-		segmentAge        = prometheus.NewHistogram(prometheus.HistogramOpts{})
-		segmentSize       = prometheus.NewHistogram(prometheus.HistogramOpts{})
 	)
 	go func() {
 		errc <- HandleConnections(
-			ln, connectionHandler, record.NewDynamicReader, log, segmentFlushAge, segmentFlushSize,
-			connectedClients, bytes, records, syncs, segmentAge, segmentSize,
+			ln, connectionHandler, "test", record.NewDynamicReader, NewIDGenerator, NewConnections(), nil, nil, log, writer, connectedClients,
 		)
 	}()
 
@@ -109,8 +106,211 @@ func TestHandleConnectionsCleanup(t *testing.T) {
 	}
 }
 
+func TestHandleConnectionsCompressed(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	log, err := NewFileLog(fs.NewVirtualFilesystem(), "/", 0, prometheus.NewCounter(prometheus.CounterOpts{}), prometheus.NewCounter(prometheus.CounterOpts{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recs := make(chan string)
+	collect := func(read record.Reader, _ *Writer, _ IDGenerator, _ io.Writer, _ prometheus.Gauge) error {
+		for {
+			r, err := read()
+			if err != nil {
+				return nil
+			}
+			recs <- string(r)
+		}
+	}
+	go HandleConnections(
+		ln, collect, "test", record.NewDynamicReader, NewIDGenerator, NewConnections(), nil, nil, log, testWriterConfig(time.Second, 1024, false),
+		prometheus.NewGauge(prometheus.GaugeOpts{}),
+	)
+
+	// Records are decompressed before they're read, once flushed.
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := WriteHello(conn, HelloCompress+"="+CompressSnappy); err != nil {
+		t.Fatal(err)
+	}
+	w := snappy.NewBufferedWriter(conn)
+	fmt.Fprint(w, "a one\na two\n")
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"a one\n", "a two\n"} {
+		select {
+		case have := <-recs:
+			if want != have {
+				t.Errorf("want %q, have %q", want, have)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for %q", want)
+		}
+	}
+
+	// Connections requesting unsupported codecs are closed.
+	conn, err = net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := WriteHello(conn, HelloCompress+"=lzma"); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("want %v, have %v", io.EOF, err)
+	}
+}
+
+func TestHandleConnectionsUnsupportedHello(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	log, err := NewFileLog(fs.NewVirtualFilesystem(), "/", 0, prometheus.NewCounter(prometheus.CounterOpts{}), prometheus.NewCounter(prometheus.CounterOpts{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recs := make(chan string, 1)
+	collect := func(read record.Reader, _ *Writer, _ IDGenerator, _ io.Writer, _ prometheus.Gauge) error {
+		for {
+			r, err := read()
+			if err != nil {
+				return nil
+			}
+			recs <- string(r)
+		}
+	}
+	go HandleConnections(
+		ln, collect, "test", record.NewDynamicReader, NewIDGenerator, NewConnections(), nil, []string{HelloAck}, log, testWriterConfig(time.Second, 1024, false),
+		prometheus.NewGauge(prometheus.GaugeOpts{}),
+	)
+
+	// Connections requesting acks are closed, before anything is read.
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := WriteHello(conn, HelloAck); err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(conn, "a one\n")
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("want connection closed, have ack")
+	}
+	select {
+	case rec := <-recs:
+		t.Errorf("want no records, have %q", rec)
+	default:
+	}
+}
+
+func TestHandleDurableWriterAcks(t *testing.T) {
+	log, err := NewFileLog(fs.NewVirtualFilesystem(), "/", 0, prometheus.NewCounter(prometheus.CounterOpts{}), prometheus.NewCounter(prometheus.CounterOpts{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewWriter(log, testWriterConfig(time.Second, 1024, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	var (
+		input = "topic_a one\ntopic_b two\ntopic_a three\n"
+		ids   []string
+		idGen = func([]byte) string {
+			id := ulid.MustNew(ulid.Now(), newStreamClock()).String()
+			ids = append(ids, id)
+			return id
+		}
+		acks bytes.Buffer
+	)
+	if err := HandleDurableWriter(
+		record.NewDynamicReader(bytes.NewBufferString(input)),
+		w, idGen, &acks,
+		prometheus.NewGauge(prometheus.GaugeOpts{}),
+	); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := strings.Join(ids, "\n")+"\n", acks.String(); want != have {
+		t.Errorf("acks: want %q, have %q", want, have)
+	}
+}
+
+func TestHandleBulkWriter(t *testing.T) {
+	log, err := NewFileLog(fs.NewVirtualFilesystem(), "/", 0, prometheus.NewCounter(prometheus.CounterOpts{}), prometheus.NewCounter(prometheus.CounterOpts{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newWriter := func() *Writer {
+		w, err := NewWriter(log, testWriterConfig(time.Hour, 1024*1024, false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+	var (
+		n     int
+		idGen = func([]byte) string { n++; return fmt.Sprintf("id%d", n) }
+		acks  bytes.Buffer
+	)
+
+	// A batch cut short is neither written nor acked.
+	w := newWriter()
+	cut := io.MultiReader(strings.NewReader("a one\na two\n"), iotest.ErrReader(io.ErrUnexpectedEOF))
+	if err := HandleBulkWriter(
+		record.NewDynamicReader(cut),
+		w, idGen, &acks,
+		prometheus.NewGauge(prometheus.GaugeOpts{}),
+	); err == nil {
+		t.Errorf("want error for a batch cut short, have none")
+	}
+	w.Stop()
+	if _, err := log.Oldest(); err != ErrNoSegmentsAvailable {
+		t.Errorf("want %v after a batch cut short, have %v", ErrNoSegmentsAvailable, err)
+	}
+	if acks.Len() > 0 {
+		t.Errorf("want no acks for a batch cut short, have %q", acks.String())
+	}
+
+	// A whole batch is written and synced, then acked as a whole.
+	w = newWriter()
+	if err := HandleBulkWriter(
+		record.NewDynamicReader(strings.NewReader("a one\na two\n")),
+		w, idGen, &acks,
+		prometheus.NewGauge(prometheus.GaugeOpts{}),
+	); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := "2\n", acks.String(); want != have {
+		t.Errorf("acks: want %q, have %q", want, have)
+	}
+	w.Stop()
+	s, err := log.Oldest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Commit()
+	if buf, err := ioutil.ReadAll(s); err != nil || string(buf) != "id3 a one\nid4 a two\n" {
+		t.Errorf("segment: have %q, %v", buf, err)
+	}
+}
+
 func echo(t *testing.T) ConnectionHandler {
-	return func(read record.Reader, w *Writer, _ IDGenerator, _ prometheus.Gauge) error {
+	return func(read record.Reader, w *Writer, _ IDGenerator, _ io.Writer, _ prometheus.Gauge) error {
 		for {
 			r, err := read()
 			if err == io.EOF {
@@ -0,0 +1,146 @@
+package ingest
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/oklog/oklog/pkg/record"
+)
+
+// Connections tracks the active connections of every connection handler, so
+// operators can inspect them, and disconnect them, via the API.
+type Connections struct {
+	mtx    sync.Mutex
+	nextID uint64
+	active map[string]*trackedConn
+}
+
+// NewConnections returns an empty, usable Connections.
+func NewConnections() *Connections {
+	return &Connections{
+		active: map[string]*trackedConn{},
+	}
+}
+
+// ConnectionInfo describes an active connection.
+type ConnectionInfo struct {
+	ID         string    `json:"id"`
+	RemoteAddr string    `json:"remote_addr"`
+	Handler    string    `json:"handler"`
+	Topic      string    `json:"topic"` // of the most recent record
+	Bytes      int64     `json:"bytes"`
+	Records    int64     `json:"records"`
+	Connected  time.Time `json:"connected"`
+}
+
+// List returns the active connections, oldest first.
+func (c *Connections) List() []ConnectionInfo {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	infos := make([]ConnectionInfo, 0, len(c.active))
+	for _, conn := range c.active {
+		infos = append(infos, conn.info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if !infos[i].Connected.Equal(infos[j].Connected) {
+			return infos[i].Connected.Before(infos[j].Connected)
+		}
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
+
+// Disconnect closes the connection with the given ID, and returns false if
+// there is no such connection. The client sees the connection close as if
+// the ingester went away, and may reconnect.
+func (c *Connections) Disconnect(id string) bool {
+	c.mtx.Lock()
+	conn, ok := c.active[id]
+	c.mtx.Unlock()
+	if !ok {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// track wraps conn, so its bytes are counted, and registers it as an active
+// connection of the named handler, until it's removed.
+func (c *Connections) track(conn net.Conn, handler string) *trackedConn {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.nextID++
+	tc := &trackedConn{
+		Conn:      conn,
+		id:        strconv.FormatUint(c.nextID, 10),
+		handler:   handler,
+		connected: time.Now(),
+	}
+	c.active[tc.id] = tc
+	return tc
+}
+
+func (c *Connections) remove(conn *trackedConn) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	delete(c.active, conn.id)
+}
+
+// trackedConn counts the bytes read from a connection, and the records read
+// from them.
+type trackedConn struct {
+	net.Conn
+	id        string
+	handler   string
+	connected time.Time
+	bytes     int64 // atomic
+	records   int64 // atomic
+	mtx       sync.Mutex
+	topic     []byte
+}
+
+func (c *trackedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.bytes, int64(n))
+	return n, err
+}
+
+// reader wraps r, so the records it returns are counted, and their topic is
+// noted.
+func (c *trackedConn) reader(r record.Reader) record.Reader {
+	return func() ([]byte, error) {
+		rec, err := r()
+		if err != nil {
+			return rec, err
+		}
+		atomic.AddInt64(&c.records, 1)
+		if i := bytes.IndexByte(rec, ' '); i >= 0 {
+			c.mtx.Lock()
+			if !bytes.Equal(c.topic, rec[:i]) {
+				c.topic = append(c.topic[:0], rec[:i]...)
+			}
+			c.mtx.Unlock()
+		}
+		return rec, nil
+	}
+}
+
+func (c *trackedConn) info() ConnectionInfo {
+	c.mtx.Lock()
+	topic := string(c.topic)
+	c.mtx.Unlock()
+	return ConnectionInfo{
+		ID:         c.id,
+		RemoteAddr: c.RemoteAddr().String(),
+		Handler:    c.handler,
+		Topic:      topic,
+		Bytes:      atomic.LoadInt64(&c.bytes),
+		Records:    atomic.LoadInt64(&c.records),
+		Connected:  c.connected,
+	}
+}
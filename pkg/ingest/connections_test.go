@@ -0,0 +1,67 @@
+package ingest
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/oklog/oklog/pkg/record"
+)
+
+func TestConnections(t *testing.T) {
+	t.Parallel()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go io.WriteString(client, "foo one\nbar two\n")
+
+	var (
+		conns = NewConnections()
+		conn  = conns.track(server, "fast")
+		read  = conn.reader(record.NewDynamicReader(conn))
+	)
+	for i := 0; i < 2; i++ {
+		if _, err := read(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// List the connection via the API.
+	api := &API{conns: conns}
+	rec := httptest.NewRecorder()
+	api.handleConnections(rec, httptest.NewRequest("GET", APIPathConnections, nil))
+	var infos []ConnectionInfo
+	if err := json.NewDecoder(rec.Body).Decode(&infos); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 1, len(infos); want != have {
+		t.Fatalf("want %d connections, have %d", want, have)
+	}
+	info := infos[0]
+	if info.ID != conn.id || info.Handler != "fast" || info.Topic != "bar" || info.Bytes != 16 || info.Records != 2 {
+		t.Errorf("unexpected connection info %+v", info)
+	}
+
+	// Disconnect it.
+	rec = httptest.NewRecorder()
+	api.handleDisconnect(rec, httptest.NewRequest("POST", APIPathDisconnect+"?id="+info.ID, nil))
+	if want, have := http.StatusOK, rec.Code; want != have {
+		t.Fatalf("disconnect: want %d, have %d", want, have)
+	}
+	if _, err := read(); err == nil {
+		t.Errorf("read from disconnected connection succeeded")
+	}
+	conns.remove(conn)
+
+	rec = httptest.NewRecorder()
+	api.handleDisconnect(rec, httptest.NewRequest("POST", APIPathDisconnect+"?id="+info.ID, nil))
+	if want, have := http.StatusNotFound, rec.Code; want != have {
+		t.Errorf("disconnect again: want %d, have %d", want, have)
+	}
+	if want, have := 0, len(conns.List()); want != have {
+		t.Errorf("want %d connections, have %d", want, have)
+	}
+}
@@ -0,0 +1,251 @@
+package ingest
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/oklog/oklog/pkg/cluster"
+	"github.com/oklog/oklog/pkg/record"
+)
+
+// DiskFullPolicy says what happens while the ingest log is too big.
+type DiskFullPolicy string
+
+const (
+	// DiskFullBlock stops reading from connections, which applies
+	// backpressure to clients.
+	DiskFullBlock DiskFullPolicy = "block"
+
+	// DiskFullRefuse stops reading from connections, and closes new ones
+	// immediately, so clients fail over to other ingesters.
+	DiskFullRefuse DiskFullPolicy = "refuse"
+)
+
+// ParseDiskFullPolicy converts a string to a valid DiskFullPolicy.
+func ParseDiskFullPolicy(s string) (DiskFullPolicy, error) {
+	switch p := DiskFullPolicy(s); p {
+	case DiskFullBlock, DiskFullRefuse:
+		return p, nil
+	default:
+		return "", fmt.Errorf("disk full policy %q invalid, must be %q or %q", s, DiskFullBlock, DiskFullRefuse)
+	}
+}
+
+// DiskMonitor watches the total size of the active, flushed, pending, and
+// quarantined segments in the ingest log. Once it reaches the high watermark, the log is
+// full, and stays full until it drains to the low watermark, e.g. as the store
+// tier consumes segments.
+type DiskMonitor struct {
+	log        Log
+	high, low  int64
+	policy     DiskFullPolicy
+	bytes      int64 // atomic
+	mtx        sync.Mutex
+	full       bool
+	notFull    chan struct{} // closed while not full
+	stop       chan chan struct{}
+	bytesGauge prometheus.Gauge
+	fullGauge  prometheus.Gauge
+	refused    prometheus.Counter
+}
+
+// NewDiskMonitor returns a usable DiskMonitor, which checks the size of the
+// log every d. A high watermark of zero disables it, but the size is still
+// measured. A low watermark of zero is 90% of the high watermark.
+func NewDiskMonitor(
+	log Log,
+	d time.Duration,
+	high, low int64,
+	policy DiskFullPolicy,
+	bytesGauge, fullGauge prometheus.Gauge,
+	refused prometheus.Counter,
+) *DiskMonitor {
+	if low <= 0 || low > high {
+		low = high / 10 * 9
+	}
+	m := &DiskMonitor{
+		log:        log,
+		high:       high,
+		low:        low,
+		policy:     policy,
+		notFull:    make(chan struct{}),
+		stop:       make(chan chan struct{}),
+		bytesGauge: bytesGauge,
+		fullGauge:  fullGauge,
+		refused:    refused,
+	}
+	close(m.notFull)
+	m.check()
+	go m.loop(d)
+	return m
+}
+
+// Listener wraps ln, so new connections are closed immediately while the log
+// is full, with the DiskFullRefuse policy.
+func (m *DiskMonitor) Listener(ln net.Listener) net.Listener {
+	if m.high <= 0 || m.policy != DiskFullRefuse {
+		return ln
+	}
+	return &diskFullListener{ln, m}
+}
+
+// PacketConn wraps pc, so packets are discarded while the log is full, and
+// counted in dropped. Unlike connections, packets can't be held back.
+func (m *DiskMonitor) PacketConn(pc net.PacketConn, dropped prometheus.Counter) net.PacketConn {
+	if m.high <= 0 {
+		return pc
+	}
+	return &diskFullPacketConn{pc, m, dropped}
+}
+
+// ReaderFactory wraps rfac, so its readers block while the log is full.
+func (m *DiskMonitor) ReaderFactory(rfac record.ReaderFactory) record.ReaderFactory {
+	if m.high <= 0 {
+		return rfac
+	}
+	return func(r io.Reader) record.Reader {
+		read := rfac(r)
+		return func() ([]byte, error) {
+			<-m.wait()
+			return read()
+		}
+	}
+}
+
+// LoadPeer wraps peer, so the load it gossips includes the size of the log,
+// and whether it's full.
+func (m *DiskMonitor) LoadPeer(peer LoadPeer) LoadPeer {
+	return diskLoadPeer{peer, m}
+}
+
+// Check returns an error while the log is full, for health checks.
+func (m *DiskMonitor) Check() error {
+	if m.isFull() {
+		return fmt.Errorf("ingest log is %d bytes, over the high watermark of %d bytes", atomic.LoadInt64(&m.bytes), m.high)
+	}
+	return nil
+}
+
+// Stop terminates the DiskMonitor, and unblocks any waiting readers.
+func (m *DiskMonitor) Stop() {
+	c := make(chan struct{})
+	m.stop <- c
+	<-c
+}
+
+func (m *DiskMonitor) loop(d time.Duration) {
+	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.check()
+
+		case c := <-m.stop:
+			m.setFull(false)
+			close(c)
+			return
+		}
+	}
+}
+
+func (m *DiskMonitor) check() {
+	stats, err := m.log.Stats()
+	if err != nil {
+		return // try again next time
+	}
+	bytes := stats.ActiveBytes + stats.FlushedBytes + stats.PendingBytes + stats.CorruptBytes
+	atomic.StoreInt64(&m.bytes, bytes)
+	m.bytesGauge.Set(float64(bytes))
+	if m.high <= 0 {
+		return
+	}
+	switch {
+	case bytes >= m.high:
+		m.setFull(true)
+	case bytes <= m.low:
+		m.setFull(false)
+	}
+}
+
+func (m *DiskMonitor) setFull(full bool) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if full == m.full {
+		return
+	}
+	m.full = full
+	if full {
+		m.notFull = make(chan struct{})
+		m.fullGauge.Set(1)
+	} else {
+		close(m.notFull)
+		m.fullGauge.Set(0)
+	}
+}
+
+func (m *DiskMonitor) isFull() bool {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.full
+}
+
+// wait returns a channel that's closed once the log isn't full.
+func (m *DiskMonitor) wait() <-chan struct{} {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.notFull
+}
+
+type diskFullListener struct {
+	net.Listener
+	m *DiskMonitor
+}
+
+func (ln *diskFullListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := ln.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if ln.m.isFull() {
+			ln.m.refused.Inc()
+			conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
+
+type diskFullPacketConn struct {
+	net.PacketConn
+	m       *DiskMonitor
+	dropped prometheus.Counter
+}
+
+func (pc *diskFullPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := pc.PacketConn.ReadFrom(p)
+		if err != nil || !pc.m.isFull() {
+			return n, addr, err
+		}
+		pc.dropped.Inc()
+	}
+}
+
+type diskLoadPeer struct {
+	LoadPeer
+	m *DiskMonitor
+}
+
+func (p diskLoadPeer) SetLoad(l cluster.Load) {
+	l.LogBytes = atomic.LoadInt64(&p.m.bytes)
+	l.DiskFull = p.m.isFull()
+	p.LoadPeer.SetLoad(l)
+}
@@ -0,0 +1,183 @@
+package ingest
+
+import (
+	"bytes"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/oklog/oklog/pkg/cluster"
+	"github.com/oklog/oklog/pkg/record"
+)
+
+func TestDiskMonitorWatermarks(t *testing.T) {
+	t.Parallel()
+
+	var (
+		log      = &sizedLog{}
+		fullness = prometheus.NewGauge(prometheus.GaugeOpts{})
+		m        = NewDiskMonitor(
+			log, time.Hour, 100, 50, DiskFullBlock,
+			prometheus.NewGauge(prometheus.GaugeOpts{}),
+			fullness,
+			prometheus.NewCounter(prometheus.CounterOpts{}),
+		)
+	)
+	defer m.Stop()
+
+	for _, testcase := range []struct {
+		bytes int64
+		full  bool
+	}{
+		{99, false},
+		{100, true},
+		{60, true}, // still above the low watermark
+		{50, false},
+		{99, false},
+	} {
+		log.set(testcase.bytes)
+		m.check()
+		if want, have := testcase.full, m.Check() != nil; want != have {
+			t.Errorf("%d bytes: full: want %v, have %v", testcase.bytes, want, have)
+		}
+		if want, have := map[bool]float64{false: 0, true: 1}[testcase.full], testutil.ToFloat64(fullness); want != have {
+			t.Errorf("%d bytes: gauge: want %v, have %v", testcase.bytes, want, have)
+		}
+	}
+}
+
+func TestDiskMonitorBlocksReaders(t *testing.T) {
+	t.Parallel()
+
+	var (
+		log = &sizedLog{}
+		m   = NewDiskMonitor(
+			log, time.Hour, 100, 0, DiskFullBlock,
+			prometheus.NewGauge(prometheus.GaugeOpts{}),
+			prometheus.NewGauge(prometheus.GaugeOpts{}),
+			prometheus.NewCounter(prometheus.CounterOpts{}),
+		)
+		peer = &recordingPeer{}
+	)
+
+	log.set(100)
+	m.check()
+	m.LoadPeer(peer).SetLoad(cluster.Load{Connections: 1})
+	if want, have := (cluster.Load{Connections: 1, LogBytes: 100, DiskFull: true}), peer.load; want != have {
+		t.Errorf("load: want %+v, have %+v", want, have)
+	}
+
+	var (
+		read = m.ReaderFactory(record.NewDynamicReader)(bytes.NewBufferString("a b\na c\n"))
+		recs = make(chan []byte)
+	)
+	go func() {
+		for {
+			rec, err := read()
+			if err != nil {
+				close(recs)
+				return
+			}
+			recs <- rec
+		}
+	}()
+	select {
+	case rec := <-recs:
+		t.Fatalf("read %q while full", rec)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	log.set(90) // the default low watermark
+	m.check()
+	if want, have := "a b\n", string(<-recs); want != have {
+		t.Fatalf("want %q, have %q", want, have)
+	}
+	if want, have := "a c\n", string(<-recs); want != have {
+		t.Fatalf("want %q, have %q", want, have)
+	}
+
+	// Stopping releases blocked readers.
+	log.set(100)
+	m.check()
+	blocked := m.ReaderFactory(record.NewDynamicReader)(bytes.NewBufferString("a d\n"))
+	go m.Stop()
+	if rec, err := blocked(); err != nil || string(rec) != "a d\n" {
+		t.Fatalf("after Stop: %q, %v", rec, err)
+	}
+}
+
+func TestDiskMonitorDropsPackets(t *testing.T) {
+	t.Parallel()
+
+	var (
+		log     = &sizedLog{}
+		dropped = prometheus.NewCounter(prometheus.CounterOpts{})
+		m       = NewDiskMonitor(
+			log, time.Hour, 100, 0, DiskFullBlock,
+			prometheus.NewGauge(prometheus.GaugeOpts{}),
+			prometheus.NewGauge(prometheus.GaugeOpts{}),
+			prometheus.NewCounter(prometheus.CounterOpts{}),
+		)
+	)
+	defer m.Stop()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	client, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	log.set(100)
+	m.check()
+	received := make(chan string)
+	go func() {
+		buf := make([]byte, 64)
+		n, _, err := m.PacketConn(pc, dropped).ReadFrom(buf)
+		if err != nil {
+			close(received)
+			return
+		}
+		received <- string(buf[:n])
+	}()
+	client.Write([]byte("while full"))
+	for testutil.ToFloat64(dropped) < 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	log.set(90) // the default low watermark
+	m.check()
+	client.Write([]byte("after"))
+	if want, have := "after", <-received; want != have {
+		t.Errorf("want %q, have %q", want, have)
+	}
+	if want, have := 1.0, testutil.ToFloat64(dropped); want != have {
+		t.Errorf("dropped: want %v, have %v", want, have)
+	}
+}
+
+// sizedLog is a Log whose stats are set by the test.
+type sizedLog struct {
+	Log
+	bytes int64 // atomic
+}
+
+func (l *sizedLog) set(bytes int64) { atomic.StoreInt64(&l.bytes, bytes) }
+
+func (l *sizedLog) Stats() (LogStats, error) {
+	return LogStats{FlushedBytes: atomic.LoadInt64(&l.bytes)}, nil
+}
+
+type recordingPeer struct {
+	LoadPeer
+	load cluster.Load
+}
+
+func (p *recordingPeer) SetLoad(l cluster.Load) { p.load = l }
@@ -0,0 +1,189 @@
+package ingest
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/oklog/oklog/pkg/cluster"
+)
+
+// Drainer empties an ingester ahead of its removal from the cluster. Once
+// started, new connections are refused, active connections are disconnected,
+// so their segments are flushed, and it waits for the store tier to commit
+// every flushed and pending segment. Then the ingester may leave the cluster.
+type Drainer struct {
+	log     Log
+	conns   *Connections
+	mtx     sync.Mutex
+	status  DrainStatus
+	started chan struct{} // closed once draining starts
+}
+
+// DrainStatus reports the progress of a drain.
+type DrainStatus struct {
+	Draining        bool      `json:"draining"`
+	Drained         bool      `json:"drained"`
+	Started         time.Time `json:"started"`
+	Connections     int       `json:"connections"`
+	ActiveBytes     int64     `json:"active_bytes"`
+	FlushedSegments int64     `json:"flushed_segments"`
+	FlushedBytes    int64     `json:"flushed_bytes"`
+	PendingSegments int64     `json:"pending_segments"`
+	PendingBytes    int64     `json:"pending_bytes"`
+}
+
+// NewDrainer returns a Drainer for the log, which disconnects the active
+// connections in conns.
+func NewDrainer(log Log, conns *Connections) *Drainer {
+	return &Drainer{
+		log:     log,
+		conns:   conns,
+		started: make(chan struct{}),
+	}
+}
+
+// Start draining. It's safe to call more than once.
+func (d *Drainer) Start() {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.status.Draining {
+		return
+	}
+	d.status.Draining = true
+	d.status.Started = time.Now()
+	close(d.started)
+}
+
+// Started returns a channel that's closed once draining starts.
+func (d *Drainer) Started() <-chan struct{} {
+	return d.started
+}
+
+// Status returns the progress of the drain, as of the last check.
+func (d *Drainer) Status() DrainStatus {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.status
+}
+
+// Wait blocks until draining has started and finished, checking its progress
+// every d, and reporting it to progress. It returns an error if canceled.
+func (d *Drainer) Wait(every time.Duration, progress func(DrainStatus), cancel <-chan struct{}) error {
+	select {
+	case <-d.started:
+	case <-cancel:
+		return errors.New("drain canceled")
+	}
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		if status, ok := d.check(); ok {
+			progress(status)
+			if status.Drained {
+				return nil
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-cancel:
+			return errors.New("drain canceled")
+		}
+	}
+}
+
+// check disconnects any active connections, and updates the status.
+func (d *Drainer) check() (DrainStatus, bool) {
+	// Connections accepted just before draining started may still arrive.
+	active := d.conns.List()
+	for _, conn := range active {
+		d.conns.Disconnect(conn.ID)
+	}
+	stats, err := d.log.Stats()
+	if err != nil {
+		return DrainStatus{}, false // try again next time
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.status.Connections = len(active)
+	d.status.ActiveBytes = stats.ActiveBytes
+	d.status.FlushedSegments = stats.FlushedSegments
+	d.status.FlushedBytes = stats.FlushedBytes
+	d.status.PendingSegments = stats.PendingSegments
+	d.status.PendingBytes = stats.PendingBytes
+	d.status.Drained = len(active) <= 0 &&
+		stats.ActiveBytes <= 0 &&
+		stats.FlushedSegments <= 0 &&
+		stats.PendingSegments <= 0
+	return d.status, true
+}
+
+func (d *Drainer) isDraining() bool {
+	select {
+	case <-d.started:
+		return true
+	default:
+		return false
+	}
+}
+
+// Listener wraps ln, so new connections are closed immediately once draining
+// starts.
+func (d *Drainer) Listener(ln net.Listener) net.Listener {
+	return &drainingListener{ln, d}
+}
+
+// PacketConn wraps pc, so packets are discarded once draining starts.
+func (d *Drainer) PacketConn(pc net.PacketConn) net.PacketConn {
+	return &drainingPacketConn{pc, d}
+}
+
+// LoadPeer wraps peer, so the load it gossips says whether we're draining.
+func (d *Drainer) LoadPeer(peer LoadPeer) LoadPeer {
+	return drainingLoadPeer{peer, d}
+}
+
+type drainingListener struct {
+	net.Listener
+	d *Drainer
+}
+
+func (ln *drainingListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := ln.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if ln.d.isDraining() {
+			conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
+
+type drainingPacketConn struct {
+	net.PacketConn
+	d *Drainer
+}
+
+func (pc *drainingPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := pc.PacketConn.ReadFrom(p)
+		if err != nil || !pc.d.isDraining() {
+			return n, addr, err
+		}
+	}
+}
+
+type drainingLoadPeer struct {
+	LoadPeer
+	d *Drainer
+}
+
+func (p drainingLoadPeer) SetLoad(l cluster.Load) {
+	l.Draining = p.d.isDraining()
+	p.LoadPeer.SetLoad(l)
+}
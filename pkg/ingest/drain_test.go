@@ -0,0 +1,98 @@
+package ingest
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/oklog/oklog/pkg/cluster"
+)
+
+func TestDrainer(t *testing.T) {
+	t.Parallel()
+
+	var (
+		log     = &statsLog{stats: LogStats{FlushedSegments: 2, FlushedBytes: 200}}
+		conns   = NewConnections()
+		drainer = NewDrainer(log, conns)
+		peer    = &recordingPeer{}
+	)
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := conns.track(server, "fast")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	ln = drainer.Listener(ln)
+
+	drainer.LoadPeer(peer).SetLoad(cluster.Load{})
+	if peer.load.Draining {
+		t.Fatal("draining before Start")
+	}
+
+	var (
+		progress = make(chan DrainStatus)
+		done     = make(chan error)
+	)
+	go func() {
+		done <- drainer.Wait(time.Millisecond, func(s DrainStatus) { progress <- s }, nil)
+	}()
+	drainer.Start()
+	drainer.Start() // idempotent
+
+	// The active connection is disconnected, and new ones are refused.
+	if s := <-progress; !s.Draining || s.Drained || s.Connections != 1 || s.FlushedSegments != 2 {
+		t.Fatalf("unexpected progress %+v", s)
+	}
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Error("active connection wasn't disconnected")
+	}
+	conns.remove(conn) // as HandleConnections does
+	go func() {
+		if conn, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+			conn.Close()
+		}
+		ln.Close()
+	}()
+	if conn, err := ln.Accept(); err == nil {
+		t.Errorf("accepted a connection from %s while draining", conn.RemoteAddr())
+	}
+	drainer.LoadPeer(peer).SetLoad(cluster.Load{})
+	if !peer.load.Draining {
+		t.Error("not draining after Start")
+	}
+
+	// Draining completes once the stores consume the flushed segments.
+	log.set(LogStats{})
+	for s := range progress {
+		if s.Drained {
+			break
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// statsLog is a Log whose stats are set by the test.
+type statsLog struct {
+	Log
+	mtx   sync.Mutex
+	stats LogStats
+}
+
+func (l *statsLog) set(stats LogStats) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.stats = stats
+}
+
+func (l *statsLog) Stats() (LogStats, error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.stats, nil
+}
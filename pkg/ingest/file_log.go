@@ -1,13 +1,17 @@
 package ingest
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/pborman/uuid"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/oklog/oklog/pkg/fs"
 )
@@ -16,13 +20,20 @@ const (
 	extActive  = ".active"
 	extFlushed = ".flushed"
 	extPending = ".pending"
+	extCorrupt = ".corrupt"
 
 	lockFile = "LOCK"
 )
 
 // NewFileLog returns a Log implemented via the filesystem.
 // All filesystem ops will be rooted at path root.
-func NewFileLog(filesys fs.Filesystem, root string) (Log, error) {
+// Records are checksummed, and damaged records are counted in corruptRecords
+// instead of being read. Segments found damaged during recovery are
+// quarantined, and counted in quarantinedSegments. Quarantined segments count
+// towards the size of the log until they're removed, once they've been kept
+// for corruptRetention; a corruptRetention of zero keeps them until they're
+// removed by hand.
+func NewFileLog(filesys fs.Filesystem, root string, corruptRetention time.Duration, corruptRecords, quarantinedSegments prometheus.Counter) (Log, error) {
 	if err := filesys.MkdirAll(root); err != nil {
 		return nil, errors.Wrapf(err, "creating path %s", root)
 	}
@@ -36,40 +47,55 @@ func NewFileLog(filesys fs.Filesystem, root string) (Log, error) {
 		// So this is like Prometheus "crash recovery" mode.
 		// But we don't have anything special we need to do.
 	}
-	if err := recoverSegments(filesys, root); err != nil {
+	if err := recoverSegments(filesys, root, corruptRecords, quarantinedSegments); err != nil {
 		return nil, errors.Wrap(err, "during recovery")
 	}
-	return &fileLog{
-		root:     root,
-		filesys:  filesys,
-		releaser: r,
-	}, nil
+	log := &fileLog{
+		root:             root,
+		filesys:          filesys,
+		releaser:         r,
+		corruptRetention: corruptRetention,
+		corruptRecords:   corruptRecords,
+	}
+	log.Stats() // removes expired quarantined segments
+	return log, nil
 }
 
 type fileLog struct {
-	root     string
-	filesys  fs.Filesystem
-	releaser fs.Releaser
+	root             string
+	filesys          fs.Filesystem
+	releaser         fs.Releaser
+	corruptRetention time.Duration
+	corruptRecords   prometheus.Counter
 }
 
-// Create returns a new writable segment.
-func (log *fileLog) Create() (WriteSegment, error) {
-	filename := filepath.Join(log.root, fmt.Sprintf("%s%s", uuid.New(), extActive))
+// Create returns a new writable segment. The topic, if any, is recorded in
+// the filename, as <uuid>.<topic>.active.
+func (log *fileLog) Create(topic string) (WriteSegment, error) {
+	name := uuid.New()
+	if topic != "" {
+		name += "." + topic
+	}
+	filename := filepath.Join(log.root, fmt.Sprintf("%s%s", name, extActive))
 
 	f, err := log.filesys.Create(filename)
 	if err != nil {
 		return nil, err
 	}
 
-	return fileWriteSegment{log.filesys, f}, nil
+	return &fileWriteSegment{fs: log.filesys, f: f}, nil
 }
 
-// Oldest returns the oldest flushed segment.
-func (log *fileLog) Oldest() (ReadSegment, error) {
+// Oldest returns the oldest flushed segment, of any of the topics, if given.
+func (log *fileLog) Oldest(topics ...string) (ReadSegment, error) {
 	var (
 		oldest = time.Now()
 		chosen string
+		want   = map[string]bool{}
 	)
+	for _, topic := range topics {
+		want[topic] = true
+	}
 	log.filesys.Walk(log.root, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -80,6 +106,9 @@ func (log *fileLog) Oldest() (ReadSegment, error) {
 		if filepath.Ext(path) != extFlushed {
 			return nil // skip
 		}
+		if len(want) > 0 && !want[segmentTopic(path)] {
+			return nil // skip
+		}
 		if t := info.ModTime(); t.Before(oldest) {
 			chosen, oldest = path, t
 		}
@@ -104,9 +133,21 @@ func (log *fileLog) Oldest() (ReadSegment, error) {
 		return nil, err
 	}
 
-	return fileReadSegment{log.filesys, f}, nil
+	return fileReadSegment{log.filesys, f, newVerifyingReader(f, log.corruptRecords)}, nil
+}
+
+// segmentTopic returns the topic in the filename of the segment at path, or
+// the empty string if its records may be of any topic.
+func segmentTopic(path string) string {
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		return name[i+1:]
+	}
+	return ""
 }
 
+// Stats walks the log. Quarantined segments kept for longer than the
+// retention are removed as they're found.
 func (log *fileLog) Stats() (LogStats, error) {
 	var stats LogStats
 	log.filesys.Walk(log.root, func(path string, info os.FileInfo, err error) error {
@@ -126,6 +167,14 @@ func (log *fileLog) Stats() (LogStats, error) {
 		case extPending:
 			stats.PendingSegments++
 			stats.PendingBytes += info.Size()
+		case extCorrupt:
+			if log.corruptRetention > 0 && time.Since(info.ModTime()) > log.corruptRetention {
+				if err := log.filesys.Remove(path); err == nil {
+					return nil
+				}
+			}
+			stats.CorruptSegments++
+			stats.CorruptBytes += info.Size()
 		}
 		return nil
 	})
@@ -136,8 +185,11 @@ func (log *fileLog) Close() error {
 	return log.releaser.Release()
 }
 
-func recoverSegments(filesys fs.Filesystem, root string) error {
-	var toRename []string
+// recoverSegments verifies the segments that were being written when we
+// stopped, which a crash may have torn, and makes them available for read.
+// Flushed segments were synced whole, and are verified as they're read.
+func recoverSegments(filesys fs.Filesystem, root string, corruptRecords, quarantinedSegments prometheus.Counter) error {
+	modTimes := map[string]time.Time{}
 	filesys.Walk(root, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -147,37 +199,124 @@ func recoverSegments(filesys fs.Filesystem, root string) error {
 		}
 		switch filepath.Ext(path) {
 		case extActive, extPending:
-			toRename = append(toRename, path)
+			modTimes[path] = info.ModTime()
 		}
 		return nil
 	})
-	for _, path := range toRename {
-		var (
-			oldname = path
-			newname = modifyExtension(oldname, extFlushed)
-		)
-		if err := filesys.Rename(oldname, newname); err != nil {
-			return err
+	for path, modTime := range modTimes {
+		if err := recoverSegment(filesys, path, modTime, corruptRecords, quarantinedSegments); err != nil {
+			return errors.Wrap(err, path)
 		}
 	}
 	return nil
 }
 
+// recoverSegment checks the segment at path, which may have been torn by a
+// crash. The records before the first damaged one are kept as a flushed
+// segment, and the original file is quarantined for inspection. Its
+// modification time is when it was quarantined, so it's kept for the
+// retention from then.
+func recoverSegment(filesys fs.Filesystem, path string, modTime time.Time, corruptRecords, quarantinedSegments prometheus.Counter) error {
+	f, err := filesys.Open(path)
+	if err != nil {
+		return err
+	}
+	valid, damaged, err := verifySegment(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	flushed := modifyExtension(path, extFlushed)
+	if damaged <= 0 {
+		return filesys.Rename(path, flushed)
+	}
+
+	corruptRecords.Add(float64(damaged))
+	quarantinedSegments.Inc()
+	corrupt := modifyExtension(path, extCorrupt)
+	if err := filesys.Rename(path, corrupt); err != nil {
+		return err
+	}
+	now := time.Now()
+	filesys.Chtimes(corrupt, now, now) // or it's kept from its last write
+	if valid <= 0 {
+		return nil
+	}
+	return copySegment(filesys, corrupt, flushed, valid, modTime)
+}
+
+// copySegment copies the first n bytes of the segment at src to a new segment
+// at dst, with the given modification time, so it keeps its place in line.
+func copySegment(filesys fs.Filesystem, src, dst string, n int64, modTime time.Time) error {
+	r, err := filesys.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := filesys.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(w, r, n); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Sync(); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return filesys.Chtimes(dst, modTime, modTime)
+}
+
 type fileWriteSegment struct {
-	fs fs.Filesystem
-	f  fs.File
+	fs      fs.Filesystem
+	f       fs.File
+	buf     []byte
+	partial []byte // of a record without a newline, yet
 }
 
-func (w fileWriteSegment) Write(p []byte) (int, error) {
-	return w.f.Write(p)
+// Write checksums each record in p. Records are written once they're
+// terminated by a newline, which may be in a later write.
+func (w *fileWriteSegment) Write(p []byte) (int, error) {
+	w.buf = w.buf[:0]
+	for rest := p; len(rest) > 0; {
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			w.partial = append(w.partial, rest...)
+			break
+		}
+		record := rest[:i+1]
+		if len(w.partial) > 0 {
+			record = append(w.partial, record...)
+			w.partial = w.partial[:0]
+		}
+		w.buf = appendChecksummed(w.buf, record)
+		rest = rest[i+1:]
+	}
+	if len(w.buf) <= 0 {
+		return len(p), nil
+	}
+	if _, err := w.f.Write(w.buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
 }
 
-func (w fileWriteSegment) Sync() error {
+func (w *fileWriteSegment) Sync() error {
 	return w.f.Sync()
 }
 
 // Close closes the segment and makes it available for read.
-func (w fileWriteSegment) Close() error {
+func (w *fileWriteSegment) Close() error {
+	if len(w.partial) > 0 {
+		if _, err := w.Write([]byte{'\n'}); err != nil {
+			return err
+		}
+	}
 	if err := w.f.Close(); err != nil {
 		return err
 	}
@@ -186,7 +325,7 @@ func (w fileWriteSegment) Close() error {
 	return w.fs.Rename(oldname, newname)
 }
 
-func (w fileWriteSegment) Delete() error {
+func (w *fileWriteSegment) Delete() error {
 	if err := w.f.Close(); err != nil {
 		return err
 	}
@@ -196,10 +335,11 @@ func (w fileWriteSegment) Delete() error {
 type fileReadSegment struct {
 	fs fs.Filesystem
 	f  fs.File
+	r  *verifyingReader
 }
 
 func (r fileReadSegment) Read(p []byte) (int, error) {
-	return r.f.Read(p)
+	return r.r.Read(p)
 }
 
 // Commit closes and deletes the segment.
@@ -1,9 +1,14 @@
 package ingest
 
 import (
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 
 	"github.com/oklog/oklog/pkg/fs"
 )
@@ -27,7 +32,7 @@ func TestRecoverSegments(t *testing.T) {
 		}
 	}
 
-	filelog, err := NewFileLog(filesys, "")
+	filelog, err := NewFileLog(filesys, "", 0, prometheus.NewCounter(prometheus.CounterOpts{}), prometheus.NewCounter(prometheus.CounterOpts{}))
 	if err != nil {
 		t.Fatalf("NewFileLog: %v", err)
 	}
@@ -59,6 +64,119 @@ func TestRecoverSegments(t *testing.T) {
 	}
 }
 
+func TestRecoverDamagedSegments(t *testing.T) {
+	t.Parallel()
+
+	var (
+		root    = t.TempDir()
+		filesys = fs.NewRealFilesystem()
+		rec1    = "01BB6RQR190000000000000000 t one\n"
+		rec2    = "01BB6RQR190000000000000001 t two\n"
+		rec3    = "01BB6RQR190000000000000002 t three\n"
+		good    = string(appendChecksummed(nil, []byte(rec1)))
+		bad     = "00000000 " + rec2
+	)
+	for filename, contents := range map[string]string{
+		"CLEAN" + extPending:   rec1 + rec2, // predates checksums
+		"TORN" + extActive:     good + string(appendChecksummed(nil, []byte(rec2)))[:20],
+		"BAD" + extPending:     good + bad + rec3,
+		"MANGLED" + extActive:  good + "0000000_" + rec2, // prefix lost its space
+		"GARBAGE" + extActive:  "garbage",
+		"FLUSHED" + extFlushed: good + bad, // verified as it's read
+	} {
+		if err := ioutil.WriteFile(filepath.Join(root, filename), []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var (
+		corruptRecords      = prometheus.NewCounter(prometheus.CounterOpts{})
+		quarantinedSegments = prometheus.NewCounter(prometheus.CounterOpts{})
+	)
+	filelog, err := NewFileLog(filesys, root, 0, corruptRecords, quarantinedSegments)
+	if err != nil {
+		t.Fatalf("NewFileLog: %v", err)
+	}
+	defer filelog.Close()
+
+	for filename, want := range map[string]string{
+		"CLEAN" + extFlushed:   rec1 + rec2,
+		"TORN" + extFlushed:    rec1,
+		"BAD" + extFlushed:     rec1,
+		"MANGLED" + extFlushed: rec1,
+		"GARBAGE" + extFlushed: "",
+	} {
+		f, err := filesys.Open(filepath.Join(root, filename))
+		if os.IsNotExist(err) && want == "" {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		have, err := ioutil.ReadAll(newVerifyingReader(f, corruptRecords))
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want != string(have) {
+			t.Errorf("%s: want %q, have %q", filename, want, have)
+		}
+	}
+	for _, filename := range []string{"TORN", "BAD", "MANGLED", "GARBAGE"} {
+		if !filesys.Exists(filepath.Join(root, filename+extCorrupt)) {
+			t.Errorf("%s wasn't quarantined", filename)
+		}
+	}
+	if filesys.Exists(filepath.Join(root, "FLUSHED"+extCorrupt)) {
+		t.Errorf("FLUSHED was quarantined")
+	}
+	if want, have := 5.0, testutil.ToFloat64(corruptRecords); want != have {
+		t.Errorf("corrupt records: want %v, have %v", want, have)
+	}
+	if want, have := 4.0, testutil.ToFloat64(quarantinedSegments); want != have {
+		t.Errorf("quarantined segments: want %v, have %v", want, have)
+	}
+}
+
+func TestCorruptRetention(t *testing.T) {
+	t.Parallel()
+
+	var (
+		root    = t.TempDir()
+		filesys = fs.NewRealFilesystem()
+		old     = time.Now().Add(-2 * time.Hour)
+	)
+	for filename, contents := range map[string]string{
+		"OLD" + extCorrupt:     "old\n",
+		"NEW" + extCorrupt:     "newer\n",
+		"TORN" + extActive:     "torn", // quarantined now
+		"FLUSHED" + extFlushed: "",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(root, filename), []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := filesys.Chtimes(filepath.Join(root, "OLD"+extCorrupt), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	filelog, err := NewFileLog(filesys, root, time.Hour, prometheus.NewCounter(prometheus.CounterOpts{}), prometheus.NewCounter(prometheus.CounterOpts{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filelog.Close()
+	if filesys.Exists(filepath.Join(root, "OLD"+extCorrupt)) {
+		t.Errorf("OLD wasn't removed after the retention")
+	}
+	stats, err := filelog.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := (LogStats{FlushedSegments: 1, CorruptSegments: 2, CorruptBytes: 10}), stats; want != have {
+		t.Errorf("want %+v, have %+v", want, have)
+	}
+}
+
 func TestLockBehavior(t *testing.T) {
 	t.Parallel()
 
@@ -83,13 +201,13 @@ func TestLockBehavior(t *testing.T) {
 			f.Close()
 
 			// NewFileLog should manage this fine.
-			filelog, err := NewFileLog(filesys, root)
+			filelog, err := NewFileLog(filesys, root, 0, prometheus.NewCounter(prometheus.CounterOpts{}), prometheus.NewCounter(prometheus.CounterOpts{}))
 			if err != nil {
 				t.Fatalf("initial NewFileLog: %v", err)
 			}
 
 			// But a second FileLog should fail.
-			if _, err := NewFileLog(filesys, root); err == nil {
+			if _, err := NewFileLog(filesys, root, 0, prometheus.NewCounter(prometheus.CounterOpts{}), prometheus.NewCounter(prometheus.CounterOpts{})); err == nil {
 				t.Fatalf("second NewFileLog: want error, have none")
 			} else {
 				t.Logf("second NewFileLog: got expected error: %v", err)
@@ -0,0 +1,82 @@
+package ingest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// HelloPrefix begins the optional handshake line a client may send before its
+// first record. Records never start with a NUL byte, so clients that don't
+// speak the handshake are never mistaken for ones that do.
+const HelloPrefix = "\x00oklog"
+
+// These are the options a client may request in its hello.
+const (
+	// HelloAck requests that the ingester write back the ULID assigned to
+	// each record, followed by a newline, once the record is persisted.
+	// Records deliberately dropped by the ingester are acked with "-".
+	HelloAck = "ack"
+
+	// HelloProducer identifies the client as a producer, e.g. producer=name,
+	// whose records are each prefixed by a sequence number and a time, as
+	// "<seq>:<unix ms> ". Redelivered records are identified by them, and
+	// dropped as duplicates.
+	HelloProducer = "producer"
+
+	// HelloEpoch distinguishes runs of a producer, e.g. epoch=<unix ms> of
+	// when it started, as sequence numbers restart with each run.
+	HelloEpoch = "epoch"
+
+	// HelloCompress requests that the rest of what the client writes, after
+	// the hello, is decompressed with the given codec, e.g. compress=snappy.
+	// Acks aren't compressed. Ingesters close connections requesting codecs
+	// they don't support.
+	HelloCompress = "compress"
+)
+
+// CompressSnappy is the snappy framing format, which clients should flush
+// periodically, so records aren't held back for long.
+const CompressSnappy = "snappy"
+
+// WriteHello writes a handshake line requesting the given options.
+// Options are either a bare name, or name=value.
+func WriteHello(w io.Writer, options ...string) error {
+	_, err := fmt.Fprintf(w, "%s %s\n", HelloPrefix, strings.Join(options, " "))
+	return err
+}
+
+// hello holds the options requested by a client.
+type hello map[string]string
+
+func (h hello) has(option string) bool {
+	_, ok := h[option]
+	return ok
+}
+
+// readHello consumes the handshake line from br, if there is one.
+// Clients that don't send a hello get an empty set of options.
+func readHello(br *bufio.Reader) (hello, error) {
+	h := hello{}
+	b, err := br.Peek(1)
+	if err != nil || b[0] != HelloPrefix[0] {
+		return h, nil // let the record reader deal with it
+	}
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return h, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) <= 0 || fields[0] != HelloPrefix {
+		return h, fmt.Errorf("invalid hello %q", strings.TrimSpace(line))
+	}
+	for _, option := range fields[1:] {
+		if i := strings.IndexByte(option, '='); i >= 0 {
+			h[option[:i]] = option[i+1:]
+		} else {
+			h[option] = ""
+		}
+	}
+	return h, nil
+}
@@ -0,0 +1,57 @@
+package ingest
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestReadHello(t *testing.T) {
+	for _, testcase := range []struct {
+		name  string
+		input string
+		want  hello
+		rest  string
+	}{
+		{"none", "topic record\n", hello{}, "topic record\n"},
+		{"empty", HelloPrefix + "\ntopic record\n", hello{}, "topic record\n"},
+		{"ack", HelloPrefix + " ack\ntopic record\n", hello{"ack": ""}, "topic record\n"},
+		{"values", HelloPrefix + " ack foo=bar\n", hello{"ack": "", "foo": "bar"}, ""},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			br := bufio.NewReader(strings.NewReader(testcase.input))
+			h, err := readHello(br)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want, have := len(testcase.want), len(h); want != have {
+				t.Fatalf("want %d options, have %d (%v)", want, have, h)
+			}
+			for k, v := range testcase.want {
+				if have, ok := h[k]; !ok || have != v {
+					t.Errorf("%s: want %q, have %q", k, v, have)
+				}
+			}
+			rest, _ := ioutil.ReadAll(br)
+			if want, have := testcase.rest, string(rest); want != have {
+				t.Errorf("rest: want %q, have %q", want, have)
+			}
+		})
+	}
+}
+
+func TestWriteHello(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteHello(&buf, HelloAck); err != nil {
+		t.Fatal(err)
+	}
+	h, err := readHello(bufio.NewReader(&buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.has(HelloAck) {
+		t.Errorf("want %q in %v", HelloAck, h)
+	}
+}
@@ -6,11 +6,12 @@ import (
 )
 
 // Log is an abstraction for segments on an ingest node.
-// A new active segment may be created and written to.
-// The oldest flushed segment may be selected and read from.
+// A new active segment may be created and written to, optionally for the
+// records of a single topic. The oldest flushed segment, optionally of one
+// of the given topics, may be selected and read from.
 type Log interface {
-	Create() (WriteSegment, error)
-	Oldest() (ReadSegment, error)
+	Create(topic string) (WriteSegment, error)
+	Oldest(topics ...string) (ReadSegment, error)
 	Stats() (LogStats, error)
 	Close() error
 }
@@ -48,4 +49,6 @@ type LogStats struct {
 	FlushedBytes    int64
 	PendingSegments int64
 	PendingBytes    int64
+	CorruptSegments int64 // quarantined during recovery
+	CorruptBytes    int64
 }
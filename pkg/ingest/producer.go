@@ -0,0 +1,245 @@
+package ingest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/fnv"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/oklog/oklog/pkg/record"
+)
+
+// Producers, e.g. forwarders, may identify themselves in their hello, with a
+// name and an epoch, e.g. when they started, and prefix each record with a
+// sequence number, which restarts with the epoch, and the time the record was
+// produced in Unix milliseconds, as "<seq>:<ms> ". The record ID is derived
+// from those, so a record redelivered after a reconnect, to any ingester, gets
+// the same ID, and the store drops the copy when it merges segments.
+// Ingesters also drop redelivered records directly, within a window.
+
+// producerID returns the ID of the record with the given sequence number and
+// time from the producer. The entropy is a hash of the producer, followed by
+// the low 32 bits of the sequence number.
+func producerID(producer string, seq, ms uint64) ulid.ULID {
+	if ms > ulid.MaxTime() {
+		ms = ulid.MaxTime()
+	}
+	h := fnv.New64a()
+	io.WriteString(h, producer)
+	var entropy [10]byte
+	binary.BigEndian.PutUint64(entropy[:8], h.Sum64())
+	copy(entropy[:6], entropy[2:8])
+	binary.BigEndian.PutUint32(entropy[6:], uint32(seq))
+	var id ulid.ULID
+	id.SetTime(ms)
+	id.SetEntropy(entropy[:])
+	return id
+}
+
+// sequence is the sequence number and time of a record from a producer.
+type sequence struct {
+	seq, ms uint64
+	ok      bool // false if the record had none
+}
+
+// sequencedReader strips the sequence prefix from each line read from br,
+// and queues the sequences, in order, for the records read from it.
+type sequencedReader struct {
+	br      *bufio.Reader
+	buf     []byte
+	midLine bool
+	err     error
+	mtx     sync.Mutex
+	queue   []sequence
+}
+
+func newSequencedReader(br *bufio.Reader) *sequencedReader {
+	return &sequencedReader{br: br}
+}
+
+func (r *sequencedReader) Read(p []byte) (int, error) {
+	for len(r.buf) <= 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		chunk, err := r.br.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull {
+			r.err = err
+		}
+		if len(chunk) <= 0 {
+			continue
+		}
+		startsLine := !r.midLine
+		r.midLine = chunk[len(chunk)-1] != '\n'
+		if startsLine {
+			chunk = r.strip(chunk)
+		}
+		r.buf = chunk
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// strip the sequence prefix from the start of a line, and queue it.
+func (r *sequencedReader) strip(line []byte) []byte {
+	s := sequence{}
+	if i := bytes.IndexByte(line, ' '); i > 0 {
+		if j := bytes.IndexByte(line[:i], ':'); j > 0 {
+			seq, seqErr := strconv.ParseUint(string(line[:j]), 10, 64)
+			ms, msErr := strconv.ParseUint(string(line[j+1:i]), 10, 64)
+			if seqErr == nil && msErr == nil {
+				s = sequence{seq, ms, true}
+				line = line[i+1:]
+			}
+		}
+	}
+	r.mtx.Lock()
+	r.queue = append(r.queue, s)
+	r.mtx.Unlock()
+	return line
+}
+
+// next returns the sequence of the next record.
+func (r *sequencedReader) next() sequence {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if len(r.queue) <= 0 {
+		return sequence{}
+	}
+	s := r.queue[0]
+	r.queue = r.queue[1:]
+	return s
+}
+
+// producerStream reads the sequenced records of a producer from a connection.
+// Records readers must return one record per line, so multiline joining and
+// splitting oversized records misalign sequences, like acks.
+type producerStream struct {
+	producer string
+	seqs     *sequencedReader
+	read     record.Reader
+	dedup    *Deduplicator
+	idGen    IDGenerator // for records without a sequence
+	current  sequence
+}
+
+// newProducerStream returns a record reader and ID generator for the records
+// of the producer, read from br via rfac. Records redelivered within the
+// dedup window are dropped, unless dedup is nil. Records without a sequence
+// are identified by idGen.
+func newProducerStream(producer string, br *bufio.Reader, rfac record.ReaderFactory, dedup *Deduplicator, idGen IDGenerator) (record.Reader, IDGenerator) {
+	seqs := newSequencedReader(br)
+	s := &producerStream{
+		producer: producer,
+		seqs:     seqs,
+		read:     rfac(seqs),
+		dedup:    dedup,
+		idGen:    idGen,
+	}
+	return s.next, s.id
+}
+
+func (s *producerStream) next() ([]byte, error) {
+	// The handler asks for the next record only once it has written the
+	// last one, so only then is it marked as seen.
+	if s.current.ok {
+		s.dedup.mark(s.producer, s.current.seq)
+	}
+	s.current = sequence{}
+	rec, err := s.read()
+	if err != nil && err != ErrRecordDropped {
+		return rec, err
+	}
+	seq := s.seqs.next()
+	if err == nil && seq.ok && s.dedup.duplicate(s.producer, seq.seq) {
+		err = ErrRecordDropped
+	}
+	if err == nil {
+		s.current = seq
+	}
+	return rec, err
+}
+
+func (s *producerStream) id(rec []byte) string {
+	if !s.current.ok {
+		return s.idGen(rec)
+	}
+	return producerID(s.producer, s.current.seq, s.current.ms).String()
+}
+
+// Deduplicator remembers the last sequence number written from each producer,
+// so records redelivered to this ingester are dropped. Producers are
+// forgotten once they're idle for the window.
+type Deduplicator struct {
+	mtx        sync.Mutex
+	window     time.Duration
+	producers  map[string]*producerState
+	swept      time.Time
+	duplicates prometheus.Counter
+}
+
+type producerState struct {
+	last uint64
+	seen time.Time
+}
+
+// NewDeduplicator returns a usable Deduplicator. Duplicates are counted.
+func NewDeduplicator(window time.Duration, duplicates prometheus.Counter) *Deduplicator {
+	return &Deduplicator{
+		window:     window,
+		producers:  map[string]*producerState{},
+		swept:      time.Now(),
+		duplicates: duplicates,
+	}
+}
+
+// duplicate returns true if the record was already written. A nil
+// Deduplicator never finds duplicates.
+func (d *Deduplicator) duplicate(producer string, seq uint64) bool {
+	if d == nil {
+		return false
+	}
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	p, ok := d.producers[producer]
+	if !ok || seq > p.last || time.Since(p.seen) > d.window {
+		return false
+	}
+	d.duplicates.Inc()
+	return true
+}
+
+// mark the record as written.
+func (d *Deduplicator) mark(producer string, seq uint64) {
+	if d == nil {
+		return
+	}
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	now := time.Now()
+	if now.Sub(d.swept) > d.window {
+		for name, p := range d.producers {
+			if now.Sub(p.seen) > d.window {
+				delete(d.producers, name)
+			}
+		}
+		d.swept = now
+	}
+	p, ok := d.producers[producer]
+	if !ok {
+		p = &producerState{}
+		d.producers[producer] = p
+	}
+	if seq > p.last {
+		p.last = seq
+	}
+	p.seen = now
+}
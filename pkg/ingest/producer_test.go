@@ -0,0 +1,104 @@
+package ingest
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/oklog/oklog/pkg/record"
+)
+
+func TestProducerStream(t *testing.T) {
+	t.Parallel()
+
+	var (
+		duplicates = prometheus.NewCounter(prometheus.CounterOpts{})
+		dedup      = NewDeduplicator(time.Minute, duplicates)
+		long       = strings.Repeat("x", 10000)
+	)
+	type result struct {
+		record string
+		id     string // or dropped
+	}
+	for _, testcase := range []struct {
+		producer string
+		input    string
+		want     []result
+	}{
+		{
+			producer: "fwd/1",
+			input:    "1:1000 a one\n2:1000 a " + long + "\n1:1000 a one\n",
+			want: []result{
+				{"a one\n", producerID("fwd/1", 1, 1000).String()},
+				{"a " + long + "\n", producerID("fwd/1", 2, 1000).String()},
+				{"", droppedAck}, // redelivered on the same connection
+			},
+		},
+		{
+			producer: "fwd/1", // reconnected
+			input:    "2:1000 a " + long + "\n3:1001 a three\nno sequence\n",
+			want: []result{
+				{"", droppedAck},
+				{"a three\n", producerID("fwd/1", 3, 1001).String()},
+				{"no sequence\n", "arrival"},
+			},
+		},
+		{
+			producer: "fwd/2", // restarted
+			input:    "1:2000 a one\n",
+			want: []result{
+				{"a one\n", producerID("fwd/2", 1, 2000).String()},
+			},
+		},
+	} {
+		read, idGen := newProducerStream(
+			testcase.producer,
+			bufio.NewReader(strings.NewReader(testcase.input)),
+			record.NewDynamicReader,
+			dedup,
+			func([]byte) string { return "arrival" },
+		)
+		for _, want := range testcase.want {
+			rec, err := read()
+			if want.id == droppedAck {
+				if err != ErrRecordDropped {
+					t.Errorf("%s: want %v, have %q, %v", testcase.producer, ErrRecordDropped, rec, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", testcase.producer, err)
+			}
+			if want, have := want.record, string(rec); want != have {
+				t.Errorf("%s: record: want %.20q, have %.20q", testcase.producer, want, have)
+			}
+			if want, have := want.id, idGen(rec); want != have {
+				t.Errorf("%s: ID: want %s, have %s", testcase.producer, want, have)
+			}
+		}
+		if _, err := read(); err != io.EOF {
+			t.Errorf("%s: want EOF, have %v", testcase.producer, err)
+		}
+	}
+	if want, have := 2.0, testutil.ToFloat64(duplicates); want != have {
+		t.Errorf("duplicates: want %v, have %v", want, have)
+	}
+}
+
+func TestProducerIDsSort(t *testing.T) {
+	t.Parallel()
+
+	var prev string
+	for _, s := range []sequence{{1, 1000, true}, {2, 1000, true}, {3, 1001, true}, {4, 1001, true}} {
+		id := producerID("fwd", s.seq, s.ms).String()
+		if id <= prev {
+			t.Errorf("%+v: ID %s doesn't sort after %s", s, id, prev)
+		}
+		prev = id
+	}
+}
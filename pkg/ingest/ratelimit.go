@@ -0,0 +1,237 @@
+package ingest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/oklog/oklog/pkg/record"
+)
+
+// ErrRecordDropped is returned by rate limited record readers for records
+// dropped due to the RateLimitDrop policy. Handlers should skip the record,
+// and keep reading.
+var ErrRecordDropped = errors.New("record dropped")
+
+// ErrRateLimited is returned by rate limited record readers for records over
+// a limit with the RateLimitDisconnect policy.
+var ErrRateLimited = errors.New("rate limit exceeded")
+
+// RateLimitPolicy says what happens to records over a rate limit.
+type RateLimitPolicy string
+
+const (
+	// RateLimitBlock waits until the record is within the limit,
+	// which applies backpressure to the client.
+	RateLimitBlock RateLimitPolicy = "block"
+
+	// RateLimitDrop discards the record.
+	RateLimitDrop RateLimitPolicy = "drop"
+
+	// RateLimitDisconnect closes the connection.
+	RateLimitDisconnect RateLimitPolicy = "disconnect"
+)
+
+// ParseRateLimitPolicy converts a string to a valid RateLimitPolicy.
+func ParseRateLimitPolicy(s string) (RateLimitPolicy, error) {
+	switch p := RateLimitPolicy(s); p {
+	case RateLimitBlock, RateLimitDrop, RateLimitDisconnect:
+		return p, nil
+	default:
+		return "", fmt.Errorf("rate limit policy %q invalid, must be %q, %q, or %q", s, RateLimitBlock, RateLimitDrop, RateLimitDisconnect)
+	}
+}
+
+// RateLimit is a token bucket limit, in records per second.
+// A zero Rate means unlimited. A zero Burst allows one second's worth.
+type RateLimit struct {
+	Rate   float64
+	Burst  int
+	Policy RateLimitPolicy
+}
+
+// RateLimiter limits the records read from each connection, and the records
+// of each topic across all connections.
+type RateLimiter struct {
+	perConnection RateLimit
+	perTopic      RateLimit
+	mtx           sync.Mutex
+	topics        map[string]*tokenBucket
+	sweepAt       int // sweep idle topics once there are this many
+	dropped       *prometheus.CounterVec
+	throttled     *prometheus.CounterVec
+}
+
+// NewRateLimiter returns a usable RateLimiter. The counters are partitioned
+// by a single label, which is either "connection" or "topic".
+func NewRateLimiter(perConnection, perTopic RateLimit, dropped, throttled *prometheus.CounterVec) *RateLimiter {
+	return &RateLimiter{
+		perConnection: perConnection,
+		perTopic:      perTopic,
+		topics:        map[string]*tokenBucket{},
+		sweepAt:       topicSweepMin,
+		dropped:       dropped,
+		throttled:     throttled,
+	}
+}
+
+// ReaderFactory wraps rfac, so that records from its readers are limited.
+// Each reader counts as a connection.
+func (l *RateLimiter) ReaderFactory(rfac record.ReaderFactory) record.ReaderFactory {
+	if l.perConnection.Rate <= 0 && l.perTopic.Rate <= 0 {
+		return rfac
+	}
+	return func(r io.Reader) record.Reader {
+		var (
+			read = rfac(r)
+			conn = newTokenBucket(l.perConnection)
+		)
+		return func() ([]byte, error) {
+			rec, err := read()
+			if err != nil {
+				return rec, err
+			}
+			if err := l.admit(conn, l.perConnection.Policy, "connection"); err != nil {
+				return nil, err
+			}
+			if err := l.admit(l.topic(rec), l.perTopic.Policy, "topic"); err != nil {
+				return nil, err
+			}
+			return rec, nil
+		}
+	}
+}
+
+func (l *RateLimiter) admit(b *tokenBucket, policy RateLimitPolicy, label string) error {
+	if b == nil {
+		return nil
+	}
+	switch policy {
+	case RateLimitDrop, RateLimitDisconnect:
+		if b.allow() {
+			return nil
+		}
+		l.dropped.WithLabelValues(label).Inc()
+		if policy == RateLimitDrop {
+			return ErrRecordDropped
+		}
+		return ErrRateLimited
+	default:
+		if d := b.reserve(); d > 0 {
+			l.throttled.WithLabelValues(label).Inc()
+			time.Sleep(d)
+		}
+		return nil
+	}
+}
+
+// topic returns the bucket for the record's topic, or nil if unlimited.
+func (l *RateLimiter) topic(rec []byte) *tokenBucket {
+	if l.perTopic.Rate <= 0 {
+		return nil
+	}
+	topic := rec
+	if i := bytes.IndexByte(rec, ' '); i >= 0 {
+		topic = rec[:i]
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	b, ok := l.topics[string(topic)]
+	if !ok {
+		if len(l.topics) >= l.sweepAt {
+			l.sweep()
+		}
+		b = newTokenBucket(l.perTopic)
+		l.topics[string(topic)] = b
+	}
+	return b
+}
+
+// topicSweepMin is how many topic buckets there may be before idle ones are
+// swept, as with dynamic topics, clients may name as many as they like.
+const topicSweepMin = 1024
+
+// sweep forgets the topics whose buckets have refilled, as they'd be
+// recreated just the same. The next sweep is once the remaining topics have
+// doubled, so sweeps take amortized constant time per topic.
+func (l *RateLimiter) sweep() {
+	now := time.Now()
+	for topic, b := range l.topics {
+		if b.full(now) {
+			delete(l.topics, topic)
+		}
+	}
+	l.sweepAt = 2 * len(l.topics)
+	if l.sweepAt < topicSweepMin {
+		l.sweepAt = topicSweepMin
+	}
+}
+
+// tokenBucket is safe for concurrent use.
+type tokenBucket struct {
+	mtx    sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a full bucket for the limit, or nil if unlimited.
+func newTokenBucket(limit RateLimit) *tokenBucket {
+	if limit.Rate <= 0 {
+		return nil
+	}
+	burst := float64(limit.Burst)
+	if burst <= 0 {
+		burst = math.Max(1, math.Ceil(limit.Rate))
+	}
+	return &tokenBucket{
+		rate:   limit.Rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// full reports whether the bucket has refilled, so it's as good as new.
+func (b *tokenBucket) full(now time.Time) bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+// allow takes a token if one is available.
+func (b *tokenBucket) allow() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.refill(time.Now())
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// reserve takes a token, and returns how long to wait until it's valid.
+func (b *tokenBucket) reserve() time.Duration {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.refill(time.Now())
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
@@ -0,0 +1,124 @@
+package ingest
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/oklog/oklog/pkg/record"
+)
+
+func TestRateLimiter(t *testing.T) {
+	input := strings.Repeat("a x\nb x\n", 5) // 10 records, 5 per topic
+	for _, testcase := range []struct {
+		name          string
+		perConnection RateLimit
+		perTopic      RateLimit
+		records       int
+		dropped       float64
+		err           error
+	}{
+		{
+			name:    "unlimited",
+			records: 10,
+		},
+		{
+			name:          "connection drop",
+			perConnection: RateLimit{Rate: 0.001, Burst: 4, Policy: RateLimitDrop},
+			records:       4,
+			dropped:       6,
+		},
+		{
+			name:     "topic drop",
+			perTopic: RateLimit{Rate: 0.001, Burst: 3, Policy: RateLimitDrop},
+			records:  6,
+			dropped:  4,
+		},
+		{
+			name:          "connection disconnect",
+			perConnection: RateLimit{Rate: 0.001, Burst: 2, Policy: RateLimitDisconnect},
+			records:       2,
+			dropped:       1,
+			err:           ErrRateLimited,
+		},
+		{
+			name:     "topic block",
+			perTopic: RateLimit{Rate: 1000, Burst: 1, Policy: RateLimitBlock},
+			records:  10,
+		},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			var (
+				dropped   = prometheus.NewCounterVec(prometheus.CounterOpts{}, []string{"limit"})
+				throttled = prometheus.NewCounterVec(prometheus.CounterOpts{}, []string{"limit"})
+				limiter   = NewRateLimiter(testcase.perConnection, testcase.perTopic, dropped, throttled)
+				read      = limiter.ReaderFactory(record.NewDynamicReader)(strings.NewReader(input))
+				records   int
+				err       error
+			)
+			for {
+				if _, err = read(); err == ErrRecordDropped {
+					continue
+				} else if err != nil {
+					break
+				}
+				records++
+			}
+			if err == io.EOF {
+				err = nil
+			}
+			if want, have := testcase.err, err; want != have {
+				t.Errorf("err: want %v, have %v", want, have)
+			}
+			if want, have := testcase.records, records; want != have {
+				t.Errorf("records: want %d, have %d", want, have)
+			}
+			var totalDropped float64
+			for _, label := range []string{"connection", "topic"} {
+				totalDropped += testutil.ToFloat64(dropped.WithLabelValues(label))
+			}
+			if want, have := testcase.dropped, totalDropped; want != have {
+				t.Errorf("dropped: want %v, have %v", want, have)
+			}
+		})
+	}
+}
+
+func TestTokenBucketReserve(t *testing.T) {
+	b := newTokenBucket(RateLimit{Rate: 10, Burst: 1})
+	if d := b.reserve(); d != 0 {
+		t.Errorf("first reservation: want no wait, have %s", d)
+	}
+	if d := b.reserve(); d <= 0 || d > 100*time.Millisecond {
+		t.Errorf("second reservation: want wait of about 100ms, have %s", d)
+	}
+}
+
+func TestRateLimiterSweepsIdleTopics(t *testing.T) {
+	l := NewRateLimiter(
+		RateLimit{},
+		RateLimit{Rate: 1, Burst: 1, Policy: RateLimitDrop},
+		prometheus.NewCounterVec(prometheus.CounterOpts{}, []string{"limit"}),
+		prometheus.NewCounterVec(prometheus.CounterOpts{}, []string{"limit"}),
+	)
+
+	// A busy topic keeps its bucket; idle ones, which are full, are swept.
+	busy := l.topic([]byte("busy record\n"))
+	if !busy.allow() {
+		t.Fatal("busy: want a token")
+	}
+	for i := 0; i < 10*topicSweepMin; i++ {
+		l.topic([]byte(fmt.Sprintf("t%d record\n", i)))
+	}
+	if n := len(l.topics); n > topicSweepMin {
+		t.Errorf("want at most %d topics, have %d", topicSweepMin, n)
+	}
+	if b := l.topic([]byte("busy record\n")); b != busy {
+		t.Error("busy topic's bucket was swept")
+	}
+}
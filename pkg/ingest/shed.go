@@ -0,0 +1,186 @@
+package ingest
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/oklog/oklog/pkg/cluster"
+)
+
+// LoadPeer models cluster.Peer.
+type LoadPeer interface {
+	Name() string
+	SetLoad(cluster.Load)
+	Loads(cluster.PeerType) map[string]cluster.Load
+}
+
+// LoadShedder measures the load of this ingester, gossips it to the cluster,
+// and refuses new connections while this ingester is much busier than its
+// peers. Forwarders then reconnect to other, more lightly loaded ingesters.
+type LoadShedder struct {
+	peer           LoadPeer
+	factor         float64
+	minConnections int
+	connections    int64  // atomic
+	bytes          uint64 // atomic
+	shedding       int32  // atomic
+	stop           chan chan struct{}
+	sheddingGauge  prometheus.Gauge
+	shedCounter    prometheus.Counter
+}
+
+// NewLoadShedder returns a usable LoadShedder, which reports load every d.
+// Connections are refused if this ingester has at least minConnections, and
+// either its connections or its throughput exceed factor times the cluster
+// mean. A factor of zero disables shedding, but load is still reported.
+func NewLoadShedder(
+	peer LoadPeer,
+	d time.Duration,
+	factor float64,
+	minConnections int,
+	sheddingGauge prometheus.Gauge,
+	shedCounter prometheus.Counter,
+) *LoadShedder {
+	s := &LoadShedder{
+		peer:           peer,
+		factor:         factor,
+		minConnections: minConnections,
+		stop:           make(chan chan struct{}),
+		sheddingGauge:  sheddingGauge,
+		shedCounter:    shedCounter,
+	}
+	go s.loop(d)
+	return s
+}
+
+// Listener wraps ln, so connections it accepts count toward our load, and
+// new connections are closed immediately while we're shedding load.
+func (s *LoadShedder) Listener(ln net.Listener) net.Listener {
+	return &sheddingListener{ln, s}
+}
+
+// Stop terminates the LoadShedder.
+func (s *LoadShedder) Stop() {
+	c := make(chan struct{})
+	s.stop <- c
+	<-c
+}
+
+func (s *LoadShedder) loop(d time.Duration) {
+	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case now := <-ticker.C:
+			var (
+				bytes    = atomic.SwapUint64(&s.bytes, 0)
+				shedding = atomic.LoadInt32(&s.shedding) == 1
+			)
+			s.peer.SetLoad(cluster.Load{
+				Connections:    int(atomic.LoadInt64(&s.connections)),
+				BytesPerSecond: float64(bytes) / now.Sub(last).Seconds(),
+				Shedding:       shedding,
+				Time:           now,
+			})
+			last = now
+
+			shedding = shouldShed(s.peer.Name(), s.peer.Loads(cluster.PeerTypeIngest), s.factor, s.minConnections, shedding)
+			if shedding {
+				atomic.StoreInt32(&s.shedding, 1)
+				s.sheddingGauge.Set(1)
+			} else {
+				atomic.StoreInt32(&s.shedding, 0)
+				s.sheddingGauge.Set(0)
+			}
+
+		case c := <-s.stop:
+			close(c)
+			return
+		}
+	}
+}
+
+// shouldShed decides if the ingester named self should refuse connections.
+// Once shedding, we keep at it until we're back at the mean, so we don't flap.
+// To avoid refusing service cluster-wide, at most a quarter of the ingesters
+// (but at least one) may shed at once.
+func shouldShed(self string, loads map[string]cluster.Load, factor float64, minConnections int, shedding bool) bool {
+	local, ok := loads[self]
+	if !ok || factor <= 0 || len(loads) < 2 || local.Connections < minConnections {
+		return false
+	}
+	var (
+		connections    float64
+		bytesPerSecond float64
+		othersShedding int
+	)
+	for name, l := range loads {
+		connections += float64(l.Connections)
+		bytesPerSecond += l.BytesPerSecond
+		if name != self && l.Shedding {
+			othersShedding++
+		}
+	}
+	var (
+		n                  = float64(len(loads))
+		meanConnections    = connections / n
+		meanBytesPerSecond = bytesPerSecond / n
+	)
+	if shedding {
+		factor = 1
+	}
+	overloaded := float64(local.Connections) > factor*meanConnections ||
+		(meanBytesPerSecond > 0 && local.BytesPerSecond > factor*meanBytesPerSecond)
+	if !overloaded {
+		return false
+	}
+	maxShedding := len(loads) / 4
+	if maxShedding < 1 {
+		maxShedding = 1
+	}
+	return shedding || othersShedding < maxShedding
+}
+
+type sheddingListener struct {
+	net.Listener
+	s *LoadShedder
+}
+
+func (ln *sheddingListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := ln.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if atomic.LoadInt32(&ln.s.shedding) == 1 {
+			ln.s.shedCounter.Inc()
+			conn.Close()
+			continue
+		}
+		atomic.AddInt64(&ln.s.connections, 1)
+		return &loadConn{Conn: conn, s: ln.s}, nil
+	}
+}
+
+// loadConn counts the bytes read from the connection toward our load.
+type loadConn struct {
+	net.Conn
+	s    *LoadShedder
+	once sync.Once
+}
+
+func (c *loadConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddUint64(&c.s.bytes, uint64(n))
+	return n, err
+}
+
+func (c *loadConn) Close() error {
+	c.once.Do(func() { atomic.AddInt64(&c.s.connections, -1) })
+	return c.Conn.Close()
+}
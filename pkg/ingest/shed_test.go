@@ -0,0 +1,65 @@
+package ingest
+
+import (
+	"testing"
+
+	"github.com/oklog/oklog/pkg/cluster"
+)
+
+func TestShouldShed(t *testing.T) {
+	for _, testcase := range []struct {
+		name     string
+		loads    map[string]cluster.Load
+		shedding bool
+		want     bool
+	}{
+		{
+			name:  "alone",
+			loads: map[string]cluster.Load{"self": {Connections: 100}},
+			want:  false,
+		},
+		{
+			name:  "balanced",
+			loads: map[string]cluster.Load{"self": {Connections: 20}, "a": {Connections: 20}},
+			want:  false,
+		},
+		{
+			name:  "too few connections",
+			loads: map[string]cluster.Load{"self": {Connections: 9}, "a": {Connections: 0}},
+			want:  false,
+		},
+		{
+			name:  "too many connections",
+			loads: map[string]cluster.Load{"self": {Connections: 40}, "a": {Connections: 10}},
+			want:  true,
+		},
+		{
+			name:  "too many bytes",
+			loads: map[string]cluster.Load{"self": {Connections: 10, BytesPerSecond: 1000}, "a": {Connections: 10, BytesPerSecond: 100}},
+			want:  true,
+		},
+		{
+			name:  "someone else is already shedding",
+			loads: map[string]cluster.Load{"self": {Connections: 40}, "a": {Connections: 40, Shedding: true}, "b": {Connections: 1}},
+			want:  false,
+		},
+		{
+			name:     "keep shedding until back at the mean",
+			loads:    map[string]cluster.Load{"self": {Connections: 22}, "a": {Connections: 18}},
+			shedding: true,
+			want:     true,
+		},
+		{
+			name:     "stop shedding at the mean",
+			loads:    map[string]cluster.Load{"self": {Connections: 20}, "a": {Connections: 20}},
+			shedding: true,
+			want:     false,
+		},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			if want, have := testcase.want, shouldShed("self", testcase.loads, 1.5, 10, testcase.shedding); want != have {
+				t.Errorf("want %v, have %v", want, have)
+			}
+		})
+	}
+}
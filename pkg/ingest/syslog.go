@@ -0,0 +1,76 @@
+package ingest
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/oklog/oklog/pkg/record"
+)
+
+// HandleSyslogPackets writes each syslog message received on the packet conn,
+// e.g. UDP, to the log as a record. Syslog over streams, e.g. TCP, should use
+// HandleConnections with a record.SyslogReaderFactory instead. Messages are
+// truncated to maxSize bytes, unless it's zero, and converted to records,
+// which are read by rfac, e.g. to redact or rate limit them. Records it drops,
+// or limits as if to disconnect, are skipped, as there's no connection.
+// Terminate the function by closing the packet conn.
+func HandleSyslogPackets(
+	pc net.PacketConn,
+	topic record.SyslogTopicFunc,
+	maxSize int,
+	rfac record.ReaderFactory,
+	log Log,
+	writer WriterConfig,
+) error {
+	w, err := NewWriter(log, writer)
+	if err != nil {
+		return err
+	}
+	defer w.Stop()
+
+	var (
+		idGen = NewIDGenerator()
+		read  = rfac(&packetReader{pc: pc, topic: topic, maxSize: maxSize, buf: make([]byte, 64*1024)}) // max UDP payload
+	)
+	for {
+		rec, err := read()
+		if err == ErrRecordDropped || err == ErrRateLimited {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s %s", idGen(rec), rec); err != nil {
+			return err
+		}
+	}
+}
+
+// packetReader is an io.Reader of the records converted from the syslog
+// messages received on a packet conn, one per line.
+type packetReader struct {
+	pc      net.PacketConn
+	topic   record.SyslogTopicFunc
+	maxSize int
+	buf     []byte
+	pending []byte // of the last record, not yet read
+}
+
+func (r *packetReader) Read(p []byte) (int, error) {
+	for len(r.pending) <= 0 {
+		n, _, err := r.pc.ReadFrom(r.buf)
+		if err != nil {
+			return 0, err
+		}
+		if n <= 0 {
+			continue
+		}
+		if r.maxSize > 0 && n > r.maxSize {
+			n = r.maxSize
+		}
+		r.pending = record.SyslogRecord(r.buf[:n], r.topic)
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
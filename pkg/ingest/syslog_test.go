@@ -0,0 +1,86 @@
+package ingest
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/oklog/oklog/pkg/fs"
+	"github.com/oklog/oklog/pkg/record"
+)
+
+func TestHandleSyslogPackets(t *testing.T) {
+	log, err := NewFileLog(fs.NewVirtualFilesystem(), "/", 0, prometheus.NewCounter(prometheus.CounterOpts{}), prometheus.NewCounter(prometheus.CounterOpts{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		pc = &queuedPacketConn{packets: []string{
+			"<13>Feb  5 17:32:18 host cron[1]: tick",
+			"<13>Feb  5 17:32:19 host cron[1]: drop me",
+			"<13>Feb  5 17:32:20 host cron[1]: far too long for the maximum size",
+		}}
+		// Drop records as a rate limiter would.
+		rfac = func(r io.Reader) record.Reader {
+			read := record.NewDynamicReader(r)
+			return func() ([]byte, error) {
+				rec, err := read()
+				if err == nil && bytes.Contains(rec, []byte("drop")) {
+					return nil, ErrRecordDropped
+				}
+				return rec, err
+			}
+		}
+	)
+	if err := HandleSyslogPackets(
+		pc, record.SyslogAppNameTopic([]byte("syslog")), 40, rfac,
+		log, testWriterConfig(time.Hour, 1024*1024, false),
+	); err != errPacketConnClosed {
+		t.Fatalf("want %v, have %v", errPacketConnClosed, err)
+	}
+
+	s, err := log.Oldest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Commit()
+	buf, err := ioutil.ReadAll(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var have []string
+	for _, line := range strings.Split(strings.TrimSpace(string(buf)), "\n") {
+		have = append(have, strings.SplitN(line, " ", 2)[1]) // strip ULID
+	}
+	want := []string{
+		"cron <13>Feb  5 17:32:18 host cron[1]: tick",
+		"cron <13>Feb  5 17:32:20 host cron[1]: far to", // truncated to 40 bytes
+	}
+	if strings.Join(want, "\n") != strings.Join(have, "\n") {
+		t.Errorf("want %q, have %q", want, have)
+	}
+}
+
+var errPacketConnClosed = errors.New("closed")
+
+// queuedPacketConn returns each of its packets, then fails.
+type queuedPacketConn struct {
+	net.PacketConn
+	packets []string
+}
+
+func (pc *queuedPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	if len(pc.packets) <= 0 {
+		return 0, nil, errPacketConnClosed
+	}
+	n := copy(p, pc.packets[0])
+	pc.packets = pc.packets[1:]
+	return n, nil, nil
+}
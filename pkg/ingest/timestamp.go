@@ -0,0 +1,72 @@
+package ingest
+
+import (
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/oklog/oklog/pkg/record"
+)
+
+// EventTimeIDGenerators returns an IDGeneratorFactory whose IDGenerators
+// stamp records with the time they occurred, as read by ts, rather than the
+// time they arrive. Records without a timestamp, e.g. the continuation lines
+// of a stack trace, get the time of the record before them, or their arrival
+// time if there's none, so they don't hold back the records after them.
+//
+// Timestamps more than maxPast before, or maxFuture after, arrival are clamped
+// to those bounds. A zero bound is unlimited. Segments must be sorted, so IDs
+// never go back in time within a stream: a record older than its predecessor
+// gets the predecessor's time. Adjusted records are counted by reason, which
+// is one of "missing", "past", "future", or "reordered".
+func EventTimeIDGenerators(ts record.TimestampFunc, maxPast, maxFuture time.Duration, adjusted *prometheus.CounterVec) IDGeneratorFactory {
+	return func() IDGenerator {
+		var (
+			clock = newStreamClock()
+			last  uint64
+			first = true
+		)
+		return func(rec []byte) string {
+			now := time.Now()
+			missing := now
+			if !first {
+				missing = ulid.Time(last)
+			}
+			first = false
+			ms := eventTime(ts, rec, now, missing, maxPast, maxFuture, adjusted)
+			if ms < last {
+				adjusted.WithLabelValues("reordered").Inc()
+				ms = last
+			}
+			last = ms
+			return ulid.MustNew(ms, clock).String()
+		}
+	}
+}
+
+// eventTime returns the ULID timestamp for the record arriving at now, which
+// is missing if the record has no timestamp.
+func eventTime(ts record.TimestampFunc, rec []byte, now, missing time.Time, maxPast, maxFuture time.Duration, adjusted *prometheus.CounterVec) uint64 {
+	t, ok := ts(rec)
+	switch {
+	case !ok:
+		adjusted.WithLabelValues("missing").Inc()
+		t = missing
+	case maxPast > 0 && t.Before(now.Add(-maxPast)):
+		adjusted.WithLabelValues("past").Inc()
+		t = now.Add(-maxPast)
+	case maxFuture > 0 && t.After(now.Add(maxFuture)):
+		adjusted.WithLabelValues("future").Inc()
+		t = now.Add(maxFuture)
+	}
+
+	// ULIDs can't represent every time.
+	if t.Before(time.Unix(0, 0)) {
+		return 0
+	}
+	if ms := ulid.Timestamp(t); ms <= ulid.MaxTime() {
+		return ms
+	}
+	return ulid.MaxTime()
+}
@@ -0,0 +1,82 @@
+package ingest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/oklog/oklog/pkg/record"
+)
+
+func TestEventTimeIDGenerators(t *testing.T) {
+	t.Parallel()
+
+	var (
+		adjusted = prometheus.NewCounterVec(prometheus.CounterOpts{}, []string{"reason"})
+		idGen    = EventTimeIDGenerators(record.RFC3339Timestamp, 24*time.Hour, time.Minute, adjusted)()
+		now      = time.Now()
+		hourAgo  = now.Add(-time.Hour).UTC()
+	)
+	for _, testcase := range []struct {
+		name   string
+		record string
+		want   time.Time // approximately
+	}{
+		{"event time", "t " + hourAgo.Format(time.RFC3339Nano) + " a\n", hourAgo},
+		{"reordered", "t " + hourAgo.Add(-time.Minute).Format(time.RFC3339Nano) + " b\n", hourAgo},
+		{"missing", "t c\n", hourAgo}, // the time of the record before
+		{"after missing", "t " + hourAgo.Add(time.Minute).Format(time.RFC3339Nano) + " d\n", hourAgo.Add(time.Minute)},
+		{"past", "t 2001-01-01T00:00:00Z e\n", hourAgo.Add(time.Minute)}, // clamped to a day ago, then reordered
+		{"future", "t 2999-01-01T00:00:00Z f\n", now.Add(time.Minute)},
+	} {
+		id, err := ulid.Parse(idGen([]byte(testcase.record)))
+		if err != nil {
+			t.Fatalf("%s: %v", testcase.name, err)
+		}
+		have := ulid.Time(id.Time())
+		if d := have.Sub(testcase.want); d < -time.Second || d > time.Second {
+			t.Errorf("%s: want %v, have %v", testcase.name, testcase.want, have)
+		}
+	}
+	for reason, want := range map[string]float64{
+		"missing":   1,
+		"past":      1,
+		"future":    1,
+		"reordered": 2,
+	} {
+		if have := testutil.ToFloat64(adjusted.WithLabelValues(reason)); want != have {
+			t.Errorf("%s: want %v, have %v", reason, want, have)
+		}
+	}
+
+	// Without a record before it, a record without a timestamp gets its
+	// arrival time.
+	id, err := ulid.Parse(EventTimeIDGenerators(record.RFC3339Timestamp, 0, 0, adjusted)()([]byte("t g\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have := ulid.Time(id.Time()); have.Sub(now) < -time.Second || have.Sub(now) > time.Second {
+		t.Errorf("first missing: want %v, have %v", now, have)
+	}
+}
+
+func TestEventTimeBounds(t *testing.T) {
+	t.Parallel()
+
+	var (
+		adjusted = prometheus.NewCounterVec(prometheus.CounterOpts{}, []string{"reason"})
+		now      = time.Now()
+	)
+	for rec, want := range map[string]uint64{
+		"t 1960-01-01T00:00:00Z\n": 0,
+		"t 9999-12-31T00:00:00Z\n": ulid.Timestamp(time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)),
+		"t 1970-01-01T00:00:01Z\n": 1000,
+	} {
+		if have := eventTime(record.RFC3339Timestamp, []byte(rec), now, now, 0, 0, adjusted); want != have {
+			t.Errorf("%q: want %d, have %d", rec, want, have)
+		}
+	}
+}
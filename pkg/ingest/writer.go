@@ -1,58 +1,87 @@
 package ingest
 
 import (
+	"bytes"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/oklog/oklog/pkg/record"
 )
 
+// WriterConfig holds the settings of a Writer, and the metrics it reports.
+type WriterConfig struct {
+	FlushAge  time.Duration // rotate nonempty active segments this often
+	FlushSize int           // rotate active segments once this many bytes are written
+	PerTopic  bool          // write each topic to its own active segment
+
+	Bytes       prometheus.Counter   // written
+	Records     prometheus.Counter   // written
+	Syncs       prometheus.Counter   // of active segments to disk
+	SegmentAge  prometheus.Histogram // of segments as they're rotated
+	SegmentSize prometheus.Histogram // of segments as they're rotated
+}
+
 // NewWriter converts a Log to an io.Writer. Active segments are rotated
-// once sz bytes are written, or every d if the segment is nonempty.
-func NewWriter(
-	log Log,
-	d time.Duration,
-	sz int,
-	bytes, records, syncs prometheus.Counter,
-	age, size prometheus.Histogram,
-) (*Writer, error) {
-	curr, err := log.Create()
-	if err != nil {
-		return nil, err
-	}
+// once c.FlushSize bytes are written, or every c.FlushAge if the segment is
+// nonempty, and synced to disk as they're rotated. With c.PerTopic, each
+// topic is written to its own active segment, up to maxTopicSegments at once;
+// otherwise, and beyond that, topics share one.
+func NewWriter(log Log, c WriterConfig) (*Writer, error) {
 	w := &Writer{
-		log:     log,
-		curr:    curr,
-		cursz:   0,
-		maxsz:   sz,
-		action:  make(chan func()),
-		bytes:   bytes,
-		records: records,
-		syncs:   syncs,
-		age:     age,
-		size:    size,
-		stop:    make(chan chan struct{}),
-	}
-	go w.loop(d)
+		log:      log,
+		active:   map[string]*activeSegment{},
+		maxsz:    c.FlushSize,
+		perTopic: c.PerTopic,
+		action:   make(chan func()),
+		bytes:    c.Bytes,
+		records:  c.Records,
+		syncs:    c.Syncs,
+		age:      c.SegmentAge,
+		size:     c.SegmentSize,
+		synced:   make(chan syncResult, 1),
+		stop:     make(chan chan struct{}),
+	}
+	if !c.PerTopic {
+		// Topics share one segment, which is always open.
+		if _, err := w.segment(""); err != nil {
+			return nil, err
+		}
+	}
+	go w.loop(c.FlushAge)
 	return w, nil
 }
 
 // Writer implements io.Writer on top of a Log.
 type Writer struct {
-	log     Log
-	curr    WriteSegment
-	curts   time.Time // of first write
-	cursz   int
-	maxsz   int
-	action  chan func()
-	bytes   prometheus.Counter
-	records prometheus.Counter
-	syncs   prometheus.Counter
-	age     prometheus.Histogram
-	size    prometheus.Histogram
-	stop    chan chan struct{}
-}
-
-// Write implements io.Writer.
+	log      Log
+	active   map[string]*activeSegment // by topic
+	maxsz    int
+	perTopic bool
+	writes   uint64 // sequence number of the last write
+	durable  uint64 // sequence number of the last write on disk
+	syncing  bool
+	waiting  []syncWaiter
+	synced   chan syncResult
+	action   chan func()
+	bytes    prometheus.Counter
+	records  prometheus.Counter
+	syncs    prometheus.Counter
+	age      prometheus.Histogram
+	size     prometheus.Histogram
+	stop     chan chan struct{}
+}
+
+type activeSegment struct {
+	WriteSegment
+	topic string
+	ts    time.Time // of first write
+	sz    int
+	dirty bool // written since the last sync started
+}
+
+// Write implements io.Writer. With perTopic, p must be a single record,
+// whose topic follows its ID.
 func (w *Writer) Write(p []byte) (int, error) {
 	type res struct {
 		n   int
@@ -60,19 +89,26 @@ func (w *Writer) Write(p []byte) (int, error) {
 	}
 	c := make(chan res)
 	w.action <- func() {
-		n, err := w.curr.Write(p)
+		s, err := w.segment(w.topic(p))
+		if err != nil {
+			c <- res{0, err}
+			return
+		}
+		n, err := s.Write(p)
 		if err != nil {
 			c <- res{n, err}
 			return
 		}
-		if w.curts.IsZero() {
-			w.curts = time.Now()
+		if s.ts.IsZero() {
+			s.ts = time.Now()
 		}
 		w.bytes.Add(float64(n))
 		w.records.Inc()
-		w.cursz += n
-		if w.cursz >= w.maxsz {
-			w.closeRotate()
+		w.writes++
+		s.sz += n
+		s.dirty = true
+		if s.sz >= w.maxsz {
+			w.closeRotate(s)
 		}
 		c <- res{n, err}
 	}
@@ -80,16 +116,124 @@ func (w *Writer) Write(p []byte) (int, error) {
 	return r.n, r.err
 }
 
-// Sync the current segment to disk.
+// topic returns the topic of the record, if segments are per topic, or the
+// empty string. Records are "ID topic payload". Topics that aren't valid,
+// and so may not be safe in filenames, share a segment.
+func (w *Writer) topic(p []byte) string {
+	if !w.perTopic {
+		return ""
+	}
+	fields := bytes.SplitN(p, []byte{' '}, 3)
+	if len(fields) < 3 || !record.IsValidTopic(fields[1]) {
+		return ""
+	}
+	return string(fields[1])
+}
+
+// maxTopicSegments is the most active segments a Writer keeps open for
+// separate topics. Records of further topics share a segment, until some of
+// them are rotated, so clients with many topics can't exhaust file handles.
+const maxTopicSegments = 64
+
+// segment returns the active segment for the topic, creating it if need be.
+func (w *Writer) segment(topic string) (*activeSegment, error) {
+	if s, ok := w.active[topic]; ok {
+		return s, nil
+	}
+	if topic != "" && len(w.active) >= maxTopicSegments {
+		return w.segment("")
+	}
+	ws, err := w.log.Create(topic)
+	if err != nil {
+		return nil, err
+	}
+	s := &activeSegment{WriteSegment: ws, topic: topic}
+	w.active[topic] = s
+	return s, nil
+}
+
+// Sync blocks until everything written so far is on disk. Concurrent calls
+// are grouped: while one sync is in progress, later calls wait for the next,
+// which covers all of them. Writes continue during a sync. Calls are grouped
+// per Writer, e.g. across the connections of HandleConnections, or the
+// durable pushes to an API, which each share one.
 func (w *Writer) Sync() error {
-	c := make(chan error)
+	c := make(chan error, 1)
 	w.action <- func() {
-		c <- w.curr.Sync()
-		w.syncs.Inc()
+		if w.writes <= w.durable {
+			c <- nil
+			return
+		}
+		w.waiting = append(w.waiting, syncWaiter{w.writes, c})
+		w.startSync()
 	}
 	return <-c
 }
 
+type syncWaiter struct {
+	seq uint64
+	c   chan<- error
+}
+
+type syncResult struct {
+	seq uint64
+	err error
+}
+
+// startSync syncs the segments written since the last sync in the
+// background, unless a sync is already in progress, in which case it's
+// started when that one finishes. Segments rotated meanwhile were synced as
+// they were closed.
+func (w *Writer) startSync() {
+	if w.syncing || len(w.waiting) <= 0 {
+		return
+	}
+	w.syncing = true
+	var dirty []WriteSegment
+	for _, s := range w.active {
+		if s.dirty {
+			dirty = append(dirty, s.WriteSegment)
+			s.dirty = false
+		}
+	}
+	seq := w.writes
+	go func() {
+		for _, s := range dirty {
+			if err := s.Sync(); err != nil {
+				w.synced <- syncResult{seq, err}
+				return
+			}
+		}
+		w.synced <- syncResult{seq, nil}
+	}()
+}
+
+// finishSync notifies the waiters covered by a sync, and starts the next one.
+func (w *Writer) finishSync(res syncResult) {
+	w.syncing = false
+	w.syncs.Inc()
+	if res.err != nil {
+		w.notify(res.seq, res.err)
+	} else if res.seq > w.durable {
+		w.durable = res.seq
+	}
+	w.notify(w.durable, nil)
+	w.startSync()
+}
+
+// notify the waiters for writes up to seq.
+func (w *Writer) notify(seq uint64, err error) {
+	waiting := w.waiting[:0]
+	for _, s := range w.waiting {
+		if s.seq <= seq {
+			s.c <- err
+		} else {
+			waiting = append(waiting, s)
+		}
+	}
+	w.waiting = waiting
+}
+
 // Stop terminates the Writer. No further writes are allowed.
 func (w *Writer) Stop() {
 	c := make(chan struct{})
@@ -112,16 +256,20 @@ func (w *Writer) loop(d time.Duration) {
 		case f := <-w.action:
 			f()
 
+		case res := <-w.synced:
+			w.finishSync(res)
+
 		case <-rotate.C:
-			// Note we invoke closeRotate every d, even if it's been only a
+			// Note we invoke rotateAll every d, even if it's been only a
 			// short while since the last flush to disk. This could be optimized
 			// by only starting the timer once bytes are written and resetting
 			// it with every segment rotation, at the cost of some garbage
 			// generation. Profiling data is necessary.
-			w.closeRotate()
+			w.rotateAll()
 
 		case c := <-w.stop:
 			w.closeOnly()
+			w.notify(w.writes, nil) // closeOnly synced everything
 			w.stop = nil
 			close(c)
 			return
@@ -129,42 +277,59 @@ func (w *Writer) loop(d time.Duration) {
 	}
 }
 
-func (w *Writer) closeRotate() {
-	if w.cursz <= 0 {
+// rotateAll closes every nonempty active segment.
+func (w *Writer) rotateAll() {
+	for _, s := range w.active {
+		w.closeRotate(s)
+	}
+}
+
+// closeRotate closes the active segment, if it's nonempty. With perTopic,
+// the next segment for the topic is created by the next write to it.
+func (w *Writer) closeRotate(s *activeSegment) {
+	if s.sz <= 0 {
 		// closeRotate is called, but the segment is empty!
 		// We can just keep it open, instead of cycling it.
 		return
 	}
-	if w.curr != nil {
-		if err := w.curr.Close(); err != nil {
+	w.closeSynced(s)
+	delete(w.active, s.topic)
+	if !w.perTopic {
+		if _, err := w.segment(s.topic); err != nil {
 			panic(err)
 		}
-		w.age.Observe(time.Since(w.curts).Seconds())
-		w.size.Observe(float64(w.cursz))
-	}
-	next, err := w.log.Create()
-	if err != nil {
-		panic(err)
 	}
-	w.curr, w.curts, w.cursz = next, time.Time{}, 0
 }
 
 func (w *Writer) closeOnly() {
-	// This function exists because we need to rotate the active segment away
-	// when the user requests a stop. That is, we shouldn't leave an active
-	// segment lying around.
-	if w.curr != nil {
-		if w.cursz <= 0 {
+	// This function exists because we need to rotate the active segments
+	// away when the user requests a stop. That is, we shouldn't leave an
+	// active segment lying around.
+	for _, s := range w.active {
+		if s.sz <= 0 {
 			// closeOnly is called, but the segment is empty!
 			// Delete the active segment instead of syncing it.
-			w.curr.Delete()
+			s.Delete()
 		} else {
-			if err := w.curr.Close(); err != nil {
-				panic(err)
-			}
-			w.age.Observe(time.Since(w.curts).Seconds())
-			w.size.Observe(float64(w.cursz))
+			w.closeSynced(s)
 		}
-		w.curr, w.curts, w.cursz = nil, time.Time{}, 0
+		delete(w.active, s.topic)
+	}
+}
+
+// closeSynced syncs and closes the segment, so a Sync after the rotation,
+// which won't sync this segment, still covers the writes to it.
+func (w *Writer) closeSynced(s *activeSegment) {
+	for w.syncing {
+		w.finishSync(<-w.synced) // it may be syncing this segment
+	}
+	if err := s.Sync(); err != nil {
+		panic(err)
+	}
+	w.syncs.Inc()
+	if err := s.Close(); err != nil {
+		panic(err)
 	}
+	w.age.Observe(time.Since(s.ts).Seconds())
+	w.size.Observe(float64(s.sz))
 }
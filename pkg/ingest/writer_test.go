@@ -0,0 +1,370 @@
+package ingest
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/oklog/oklog/pkg/fs"
+	"github.com/oklog/oklog/pkg/record"
+)
+
+// testWriterConfig returns a WriterConfig with the given settings, and
+// metrics that aren't registered.
+func testWriterConfig(flushAge time.Duration, flushSize int, perTopic bool) WriterConfig {
+	return WriterConfig{
+		FlushAge:    flushAge,
+		FlushSize:   flushSize,
+		PerTopic:    perTopic,
+		Bytes:       prometheus.NewCounter(prometheus.CounterOpts{}),
+		Records:     prometheus.NewCounter(prometheus.CounterOpts{}),
+		Syncs:       prometheus.NewCounter(prometheus.CounterOpts{}),
+		SegmentAge:  prometheus.NewHistogram(prometheus.HistogramOpts{}),
+		SegmentSize: prometheus.NewHistogram(prometheus.HistogramOpts{}),
+	}
+}
+
+func TestWriterGroupCommit(t *testing.T) {
+	t.Parallel()
+
+	log := &blockingSyncLog{release: make(chan struct{})}
+	w, err := NewWriter(log, testWriterConfig(time.Hour, 1024*1024, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	// Nothing written, nothing to sync.
+	if err := w.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := int64(0), log.syncs(); want != have {
+		t.Fatalf("syncs: want %d, have %d", want, have)
+	}
+
+	// The first sync blocks.
+	first := make(chan error)
+	io.WriteString(w, "a 1\n")
+	go func() { first <- w.Sync() }()
+	if !within(time.Second, func() bool { return log.syncs() == 1 }) {
+		t.Fatal("first sync never started")
+	}
+
+	// Writes continue meanwhile, and later syncs wait for the next one.
+	io.WriteString(w, "a 2\n")
+	io.WriteString(w, "a 3\n")
+	later := make(chan error, 3)
+	for i := 0; i < cap(later); i++ {
+		go func() { later <- w.Sync() }()
+	}
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case err := <-later:
+		t.Fatalf("later sync returned (%v) before the first finished", err)
+	default:
+	}
+
+	log.release <- struct{}{}
+	if err := <-first; err != nil {
+		t.Fatal(err)
+	}
+	log.release <- struct{}{}
+	for i := 0; i < cap(later); i++ {
+		if err := <-later; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want, have := int64(2), log.syncs(); want != have {
+		t.Errorf("syncs: want %d, have %d", want, have)
+	}
+	close(log.release) // for Stop
+}
+
+func TestWriterPerTopic(t *testing.T) {
+	t.Parallel()
+
+	log, err := NewFileLog(
+		fs.NewRealFilesystem(), t.TempDir(), 0,
+		prometheus.NewCounter(prometheus.CounterOpts{}),
+		prometheus.NewCounter(prometheus.CounterOpts{}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+
+	w, err := NewWriter(log, testWriterConfig(time.Hour, 1024*1024, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range []string{
+		"01BB6RQR190000000000000000 a one\n",
+		"01BB6RQR190000000000000001 b two\n",
+		"01BB6RQR190000000000000002 a three\n",
+	} {
+		if _, err := io.WriteString(w, rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Stop()
+
+	for _, testcase := range []struct {
+		topics []string
+		want   string
+	}{
+		{[]string{"c", "b"}, "01BB6RQR190000000000000001 b two\n"},
+		{[]string{"b"}, ""},
+		{nil, "01BB6RQR190000000000000000 a one\n01BB6RQR190000000000000002 a three\n"},
+		{nil, ""},
+	} {
+		s, err := log.Oldest(testcase.topics...)
+		if testcase.want == "" {
+			if err != ErrNoSegmentsAvailable {
+				t.Errorf("Oldest(%v): want %v, have %v", testcase.topics, ErrNoSegmentsAvailable, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Oldest(%v): %v", testcase.topics, err)
+		}
+		have, err := ioutil.ReadAll(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := testcase.want; want != string(have) {
+			t.Errorf("Oldest(%v): want %q, have %q", testcase.topics, want, have)
+		}
+		if err := s.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWriterPerTopicLimit(t *testing.T) {
+	t.Parallel()
+
+	log := &topicRecordingLog{}
+	w, err := NewWriter(log, testWriterConfig(time.Hour, 1024*1024, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < maxTopicSegments+2; i++ {
+		if _, err := fmt.Fprintf(w, "01BB6RQR190000000000000000 t%d x\n", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Stop()
+
+	// Topics past the limit share a segment.
+	if want, have := maxTopicSegments+1, len(log.topics); want != have {
+		t.Fatalf("segments: want %d, have %d", want, have)
+	}
+	if want, have := "", log.topics[maxTopicSegments]; want != have {
+		t.Errorf("last segment: want topic %q, have %q", want, have)
+	}
+}
+
+// topicRecordingLog records the topic of each segment it creates.
+type topicRecordingLog struct {
+	Log
+	topics []string
+}
+
+func (l *topicRecordingLog) Create(topic string) (WriteSegment, error) {
+	l.topics = append(l.topics, topic)
+	return nopSegment{}, nil
+}
+
+type nopSegment struct{}
+
+func (nopSegment) Write(p []byte) (int, error) { return len(p), nil }
+func (nopSegment) Sync() error                 { return nil }
+func (nopSegment) Close() error                { return nil }
+func (nopSegment) Delete() error               { return nil }
+
+// blockingSyncLog creates segments whose syncs block until released.
+type blockingSyncLog struct {
+	Log
+	release chan struct{}
+	n       int64 // atomic
+}
+
+func (l *blockingSyncLog) Create(string) (WriteSegment, error) { return blockingSyncSegment{l}, nil }
+func (l *blockingSyncLog) syncs() int64                        { return atomic.LoadInt64(&l.n) }
+
+type blockingSyncSegment struct{ l *blockingSyncLog }
+
+func (s blockingSyncSegment) Write(p []byte) (int, error) { return len(p), nil }
+func (s blockingSyncSegment) Close() error                { return nil }
+func (s blockingSyncSegment) Delete() error               { return nil }
+func (s blockingSyncSegment) Sync() error {
+	atomic.AddInt64(&s.l.n, 1)
+	<-s.l.release
+	return nil
+}
+
+// BenchmarkDurableWriter compares HandleDurableWriter, which batches the
+// syncs of a connection, with syncing after each record.
+func BenchmarkDurableWriter(b *testing.B) {
+	for _, h := range []struct {
+		name    string
+		handler ConnectionHandler
+	}{
+		{"sync-per-record", syncEachRecord},
+		{"group-commit", HandleDurableWriter},
+	} {
+		b.Run(h.name, func(b *testing.B) {
+			w := newBenchmarkWriter(b)
+			defer w.Stop()
+			n := b.N
+			r := func() ([]byte, error) {
+				if n <= 0 {
+					return nil, io.EOF
+				}
+				n--
+				return benchmarkRecord, nil
+			}
+			b.SetBytes(int64(len(benchmarkRecord)))
+			b.ResetTimer()
+			if err := h.handler(r, w, NewIDGenerator(), ioutil.Discard, prometheus.NewGauge(prometheus.GaugeOpts{})); err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
+
+// BenchmarkWriterSync compares concurrent callers, each writing a record
+// and syncing it on a shared Writer, as durable pushes to the API do, with
+// serializing them, so there's one sync per record.
+func BenchmarkWriterSync(b *testing.B) {
+	for _, serialize := range []bool{true, false} {
+		name := "group-commit"
+		if serialize {
+			name = "sync-per-record"
+		}
+		b.Run(name, func(b *testing.B) {
+			var (
+				w   = newBenchmarkWriter(b)
+				mtx sync.Mutex
+			)
+			defer w.Stop()
+			b.SetBytes(int64(len(benchmarkRecord)))
+			b.SetParallelism(64)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if serialize {
+						mtx.Lock()
+					}
+					_, err := w.Write(benchmarkRecord)
+					if err == nil {
+						err = w.Sync()
+					}
+					if serialize {
+						mtx.Unlock()
+					}
+					if err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkDurableConnections compares concurrent durable connections
+// sharing a Writer, as HandleConnections does, so their syncs are grouped,
+// with each connection having its own.
+func BenchmarkDurableConnections(b *testing.B) {
+	const conns = 64
+	for _, shared := range []bool{false, true} {
+		name := "writer-per-connection"
+		if shared {
+			name = "shared-writer"
+		}
+		b.Run(name, func(b *testing.B) {
+			writers := make([]*Writer, conns)
+			for i := range writers {
+				if shared && i > 0 {
+					writers[i] = writers[0]
+					continue
+				}
+				writers[i] = newBenchmarkWriter(b)
+				defer writers[i].Stop()
+			}
+			b.SetBytes(int64(len(benchmarkRecord)))
+			b.ResetTimer()
+			var wg sync.WaitGroup
+			for i, w := range writers {
+				n := b.N / conns
+				if i < b.N%conns {
+					n++
+				}
+				r := func() ([]byte, error) {
+					if n <= 0 {
+						return nil, io.EOF
+					}
+					n--
+					return benchmarkRecord, nil
+				}
+				wg.Add(1)
+				go func(w *Writer) {
+					defer wg.Done()
+					if err := HandleDurableWriter(r, w, NewIDGenerator(), ioutil.Discard, prometheus.NewGauge(prometheus.GaugeOpts{})); err != nil {
+						b.Error(err)
+					}
+				}(w)
+			}
+			wg.Wait()
+		})
+	}
+}
+
+var benchmarkRecord = []byte("topic 0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef\n")
+
+func newBenchmarkWriter(b *testing.B) *Writer {
+	log, err := NewFileLog(
+		fs.NewRealFilesystem(), b.TempDir(), 0,
+		prometheus.NewCounter(prometheus.CounterOpts{}),
+		prometheus.NewCounter(prometheus.CounterOpts{}),
+	)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { log.Close() })
+	w, err := NewWriter(log, testWriterConfig(time.Hour, 128*1024*1024, false))
+	if err != nil {
+		b.Fatal(err)
+	}
+	return w
+}
+
+// syncEachRecord is the durable ConnectionHandler before group commit.
+func syncEachRecord(r record.Reader, w *Writer, idGen IDGenerator, ack io.Writer, connectedClients prometheus.Gauge) error {
+	for {
+		record, err := r()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		id := idGen(record)
+		if _, err := fmt.Fprintf(w, "%s %s", id, record); err != nil {
+			return err
+		}
+		if err := w.Sync(); err != nil {
+			return err
+		}
+		if err := writeAck(ack, id); err != nil {
+			return err
+		}
+	}
+}
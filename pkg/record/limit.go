@@ -0,0 +1,188 @@
+package record
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ErrRecordTooLong is returned by limited readers for records over the
+// maximum size, under the OversizeReject policy.
+var ErrRecordTooLong = errors.New("record too long")
+
+// OversizePolicy says what happens to records over the maximum size.
+type OversizePolicy string
+
+const (
+	// OversizeTruncate keeps the start of the record, and discards the rest.
+	OversizeTruncate OversizePolicy = "truncate"
+
+	// OversizeSplit emits the record as several records, each within the
+	// maximum size.
+	OversizeSplit OversizePolicy = "split"
+
+	// OversizeReject fails the reader, so the connection is closed.
+	OversizeReject OversizePolicy = "reject"
+)
+
+// ParseOversizePolicy converts a string to a valid OversizePolicy.
+func ParseOversizePolicy(s string) (OversizePolicy, error) {
+	switch p := OversizePolicy(s); p {
+	case OversizeTruncate, OversizeSplit, OversizeReject:
+		return p, nil
+	default:
+		return "", fmt.Errorf("oversize policy %q invalid, must be %q, %q, or %q", s, OversizeTruncate, OversizeSplit, OversizeReject)
+	}
+}
+
+// LimitReaderFactory wraps rfac, so its readers never buffer more than max
+// bytes per line, excluding the newline. Longer lines are handled according
+// to policy, and counted in oversized. With repeatTopic, parts of a split line
+// repeat its space-delimited topic, as required by NewDynamicReader.
+// A max of zero means unlimited.
+func LimitReaderFactory(rfac ReaderFactory, max int, policy OversizePolicy, repeatTopic bool, oversized prometheus.Counter) ReaderFactory {
+	if max <= 0 {
+		return rfac
+	}
+	return func(r io.Reader) Reader {
+		return rfac(&lineLimiter{
+			r:           r,
+			max:         max,
+			policy:      policy,
+			repeatTopic: repeatTopic,
+			oversized:   oversized,
+			backing:     make([]byte, 32*1024),
+		})
+	}
+}
+
+// lineLimiter is an io.Reader that enforces a maximum line length on the
+// stream it wraps, by truncating or splitting long lines, or failing.
+type lineLimiter struct {
+	r           io.Reader
+	max         int
+	policy      OversizePolicy
+	repeatTopic bool
+	oversized   prometheus.Counter
+
+	backing []byte
+	in      []byte // unprocessed input
+	out     []byte // processed output, not yet read
+	err     error  // from r
+
+	n        int    // length of the current line so far
+	topic    []byte // of the current line, with repeatTopic
+	topicEnd bool   // the topic of the current line is complete
+	discard  bool   // drop input until the next newline
+	counted  bool   // the current line was counted as oversized
+}
+
+func (l *lineLimiter) Read(p []byte) (int, error) {
+	for len(l.out) <= 0 {
+		if len(l.in) <= 0 {
+			if l.err != nil {
+				return 0, l.err
+			}
+			var n int
+			n, l.err = l.r.Read(l.backing)
+			l.in = l.backing[:n]
+			continue
+		}
+		if err := l.process(); err != nil {
+			l.in, l.err = nil, err
+			return 0, err
+		}
+	}
+	n := copy(p, l.out)
+	l.out = l.out[n:]
+	return n, nil
+}
+
+// process moves as much of the input to the output as it can,
+// up to and including the next newline.
+func (l *lineLimiter) process() error {
+	chunk, eol := l.in, false
+	if i := bytes.IndexByte(l.in, '\n'); i >= 0 {
+		chunk, eol = l.in[:i], true
+	}
+
+	if l.discard {
+		l.in = l.in[len(chunk):]
+		if eol {
+			l.in = l.in[1:]
+			l.out = append(l.out[:0], '\n')
+			l.reset()
+		}
+		return nil
+	}
+
+	if l.repeatTopic && !l.topicEnd {
+		t := chunk
+		if i := bytes.IndexByte(chunk, ' '); i >= 0 {
+			t, l.topicEnd = chunk[:i], true
+		}
+		l.topic = append(l.topic, t...)
+		if eol {
+			l.topicEnd = true
+		}
+	}
+
+	room := l.max - l.n
+	if len(chunk) <= room {
+		l.out = append(l.out[:0], chunk...)
+		l.in = l.in[len(chunk):]
+		l.n += len(chunk)
+		if eol {
+			l.out = append(l.out, '\n')
+			l.in = l.in[1:]
+			l.reset()
+		}
+		return nil
+	}
+
+	// The line is too long.
+	if !l.counted {
+		l.oversized.Inc()
+		l.counted = true
+	}
+	switch l.policy {
+	case OversizeReject:
+		return ErrRecordTooLong
+
+	case OversizeSplit:
+		prefix := 0
+		if l.repeatTopic {
+			prefix = len(l.topic) + 1
+		}
+		if prefix < l.max {
+			l.out = append(l.out[:0], chunk[:room]...)
+			l.out = append(l.out, '\n')
+			if l.repeatTopic {
+				l.out = append(l.out, l.topic...)
+				l.out = append(l.out, ' ')
+			}
+			l.in = l.in[room:]
+			l.n = prefix
+			return nil
+		}
+		fallthrough // the topic alone is too long to split; truncate instead
+
+	default: // OversizeTruncate
+		l.out = append(l.out[:0], chunk[:room]...)
+		l.in = l.in[room:]
+		l.discard = true
+		return nil
+	}
+}
+
+// reset prepares for a new line.
+func (l *lineLimiter) reset() {
+	l.n = 0
+	l.topic = l.topic[:0]
+	l.topicEnd = false
+	l.discard = false
+	l.counted = false
+}
@@ -0,0 +1,109 @@
+package record
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+	"testing/iotest"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLimitReaderFactory(t *testing.T) {
+	static := StaticReaderFactory([]byte("t"))
+	for _, c := range []struct {
+		name      string
+		rfac      ReaderFactory
+		policy    OversizePolicy
+		dynamic   bool
+		input     string
+		exp       []string
+		err       error
+		oversized float64
+	}{
+		{
+			name:   "within-limit",
+			rfac:   static,
+			policy: OversizeTruncate,
+			input:  "12345\n123\n\n",
+			exp:    []string{"t 12345\n", "t 123\n", "t \n"},
+		},
+		{
+			name:      "truncate",
+			rfac:      static,
+			policy:    OversizeTruncate,
+			input:     "123456789\nabc\n",
+			exp:       []string{"t 12345\n", "t abc\n"},
+			oversized: 1,
+		},
+		{
+			name:      "split",
+			rfac:      static,
+			policy:    OversizeSplit,
+			input:     "123456789012\nabc\n",
+			exp:       []string{"t 12345\n", "t 67890\n", "t 12\n", "t abc\n"},
+			oversized: 1,
+		},
+		{
+			name:      "split-dynamic",
+			rfac:      NewDynamicReader,
+			policy:    OversizeSplit,
+			dynamic:   true,
+			input:     "ab 123456\nab 1\n",
+			exp:       []string{"ab 12\n", "ab 34\n", "ab 56\n", "ab 1\n"},
+			oversized: 1,
+		},
+		{
+			name:      "split-dynamic-long-topic",
+			rfac:      NewDynamicReader,
+			policy:    OversizeSplit,
+			dynamic:   true,
+			input:     "abcdef 1\nab 1\n",
+			err:       ErrIllegalTopicName,
+			oversized: 1,
+		},
+		{
+			name:      "reject",
+			rfac:      static,
+			policy:    OversizeReject,
+			input:     "123\n123456\n123\n",
+			exp:       []string{"t 123\n"},
+			err:       ErrRecordTooLong,
+			oversized: 1,
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			for _, oneByte := range []bool{false, true} {
+				var input io.Reader = bytes.NewBufferString(c.input)
+				if oneByte {
+					input = iotest.OneByteReader(input)
+				}
+				oversized := prometheus.NewCounter(prometheus.CounterOpts{})
+				r := LimitReaderFactory(c.rfac, 5, c.policy, c.dynamic, oversized)(input)
+
+				var (
+					res []string
+					err error
+				)
+				for {
+					var rec []byte
+					if rec, err = r(); err != nil {
+						break
+					}
+					res = append(res, string(rec))
+				}
+				if err != io.EOF && err != c.err {
+					t.Fatalf("unexpected error: want %q, got %q", c.err, err)
+				}
+				if !reflect.DeepEqual(c.exp, res) {
+					t.Fatalf("unexpected records: want %q, got %q", c.exp, res)
+				}
+				if want, have := c.oversized, testutil.ToFloat64(oversized); want != have {
+					t.Fatalf("oversized records: want %v, have %v", want, have)
+				}
+			}
+		})
+	}
+}
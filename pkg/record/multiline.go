@@ -0,0 +1,160 @@
+package record
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"time"
+)
+
+// escapedNewline replaces newlines embedded in a multiline record, so that
+// each stored record remains a single line. Backslashes in every record are
+// escaped as escapedBackslash, so the lines can be told apart from text that
+// already held a backslash followed by n.
+var (
+	escapedNewline   = []byte(`\n`)
+	backslash        = []byte(`\`)
+	escapedBackslash = []byte(`\\`)
+)
+
+// MultilineReaderFactory wraps rfac, so records that don't match any of the
+// start patterns are joined onto the record before them, e.g. the lines of a
+// stack trace.
+//
+// Every record read is escaped, joined or not, so it can be decoded the same
+// way: a backslash in the input is two backslashes, and a newline between
+// joined lines is a backslash followed by n. Topics aren't escaped.
+//
+// With topics, records start with a space-delimited topic, which isn't
+// matched against the patterns, and only records of the same topic are
+// joined. A joined record is emitted when the next record starts, when no
+// further lines arrive for timeout, or when it would grow past maxSize bytes,
+// excluding the newline. A zero timeout or maxSize is unlimited.
+//
+// Readers read ahead in a goroutine, which exits once the underlying reader
+// returns an error. Callers that stop reading early should close the
+// underlying reader, and keep reading until they get an error.
+func MultilineReaderFactory(rfac ReaderFactory, start []*regexp.Regexp, topics bool, timeout time.Duration, maxSize int) ReaderFactory {
+	return func(r io.Reader) Reader {
+		type result struct {
+			record []byte
+			err    error
+		}
+		var (
+			read    = rfac(r)
+			results = make(chan result)
+			pending []byte // the record being joined, if any, escaped
+			err     error  // from read, once we've seen it
+			timer   = time.NewTimer(time.Hour)
+		)
+		timer.Stop()
+		go func() {
+			for {
+				record, err := read()
+				results <- result{record, err}
+				if err != nil {
+					return
+				}
+			}
+		}()
+
+		// startsRecord returns true if the record can't continue the pending one.
+		startsRecord := func(record []byte) bool {
+			payload := record
+			if topics {
+				i := bytes.IndexByte(record, ' ')
+				j := bytes.IndexByte(pending, ' ')
+				if i < 0 || j < 0 || !bytes.Equal(record[:i], pending[:j]) {
+					return true
+				}
+				payload = record[i+1:]
+			}
+			payload = bytes.TrimSuffix(payload, []byte{'\n'})
+			for _, re := range start {
+				if re.Match(payload) {
+					return true
+				}
+			}
+			size := len(pending) - 1 + len(escapedNewline) + len(payload) + bytes.Count(payload, backslash)
+			return maxSize > 0 && size > maxSize
+		}
+
+		// escape returns a copy of the record, with its backslashes escaped.
+		// Records may share memory with the next one read, so it's a copy
+		// either way.
+		escape := func(record []byte) []byte {
+			var i int // after the topic, which has no backslashes
+			if topics {
+				i = bytes.IndexByte(record, ' ') + 1
+			}
+			return append(append([]byte(nil), record[:i]...), bytes.Replace(record[i:], backslash, escapedBackslash, -1)...)
+		}
+
+		// join appends the payload of the record to the pending one.
+		join := func(record []byte) {
+			if topics {
+				record = record[bytes.IndexByte(record, ' ')+1:]
+			}
+			pending = append(bytes.TrimSuffix(pending, []byte{'\n'}), escapedNewline...)
+			pending = append(pending, bytes.Replace(record, backslash, escapedBackslash, -1)...)
+		}
+
+		// restartTimer flushes the pending record after timeout.
+		restartTimer := func() {
+			if timeout <= 0 {
+				return
+			}
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(timeout)
+		}
+
+		return func() ([]byte, error) {
+			for {
+				if err != nil {
+					if pending != nil {
+						record := pending
+						pending = nil
+						return record, nil
+					}
+					return nil, err
+				}
+
+				var res result
+				if pending == nil {
+					res = <-results
+				} else {
+					select {
+					case res = <-results:
+					case <-timer.C:
+						record := pending
+						pending = nil
+						return record, nil
+					}
+				}
+				if res.err != nil {
+					err = res.err
+					continue
+				}
+
+				switch {
+				case pending == nil:
+					pending = escape(res.record)
+					restartTimer()
+				case startsRecord(res.record):
+					record := pending
+					pending = escape(res.record)
+					restartTimer()
+					return record, nil
+				default:
+					join(res.record)
+					restartTimer()
+				}
+			}
+		}
+	}
+}
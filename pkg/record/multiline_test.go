@@ -0,0 +1,135 @@
+package record
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestMultilineReaderFactory(t *testing.T) {
+	start := []*regexp.Regexp{regexp.MustCompile(`^\d{4}-`)}
+	for _, c := range []struct {
+		name    string
+		rfac    ReaderFactory
+		topics  bool
+		maxSize int
+		input   string
+		exp     []string
+	}{
+		{
+			name:  "lines",
+			rfac:  NewLineReader,
+			input: "2017-01-01 one\n2017-01-01 two\n",
+			exp:   []string{"2017-01-01 one\n", "2017-01-01 two\n"},
+		},
+		{
+			name:  "stack trace",
+			rfac:  NewLineReader,
+			input: "2017-01-01 Exception\n\tat a.b(c.java:1)\n\tat d.e(f.java:2)\n2017-01-01 ok\n",
+			exp:   []string{`2017-01-01 Exception\n` + "\tat a.b(c.java:1)" + `\n` + "\tat d.e(f.java:2)\n", "2017-01-01 ok\n"},
+		},
+		{
+			name:  "leading continuation",
+			rfac:  NewLineReader,
+			input: "  orphan\n  line\n2017-01-01 ok\n",
+			exp:   []string{`  orphan\n  line` + "\n", "2017-01-01 ok\n"},
+		},
+		{
+			name:   "static topic",
+			rfac:   StaticReaderFactory([]byte("t")),
+			topics: true,
+			input:  "2017-01-01 Traceback\n  File x\nValueError\n",
+			exp:    []string{`t 2017-01-01 Traceback\n  File x\nValueError` + "\n"},
+		},
+		{
+			name:   "dynamic topics",
+			rfac:   NewDynamicReader,
+			topics: true,
+			input:  "a 2017-01-01 one\na   more\nb   other\na   again\n",
+			exp:    []string{`a 2017-01-01 one\n  more` + "\n", "b   other\n", "a   again\n"},
+		},
+		{
+			name:  "backslashes",
+			rfac:  NewLineReader,
+			input: "2017-01-01 C:\\dir\n  a\\n\n2017-01-01 \\ok\n",
+			exp:   []string{`2017-01-01 C:\\dir\n  a\\n` + "\n", `2017-01-01 \\ok` + "\n"},
+		},
+		{
+			name:  "unjoined backslash n",
+			rfac:  NewLineReader,
+			input: "2017-01-01 a\\nb\n",
+			exp:   []string{`2017-01-01 a\\nb` + "\n"}, // not a joined newline
+		},
+		{
+			name:    "max size",
+			rfac:    NewLineReader,
+			maxSize: 21,
+			input:   "2017-01-01 one\n  two\n  three\n",
+			exp:     []string{`2017-01-01 one\n  two` + "\n", "  three\n"},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			r := MultilineReaderFactory(c.rfac, start, c.topics, 0, c.maxSize)(bytes.NewBufferString(c.input))
+			var res []string
+			for {
+				rec, err := r()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				res = append(res, string(rec))
+			}
+			if !reflect.DeepEqual(c.exp, res) {
+				t.Fatalf("unexpected records: want %q, got %q", c.exp, res)
+			}
+		})
+	}
+}
+
+func TestMultilineTimeout(t *testing.T) {
+	t.Parallel()
+
+	var (
+		start  = []*regexp.Regexp{regexp.MustCompile(`^\S`)}
+		pr, pw = io.Pipe()
+		r      = MultilineReaderFactory(NewLineReader, start, false, 10*time.Millisecond, 0)(pr)
+	)
+	go io.WriteString(pw, "first\n  continued\n")
+
+	// With no further lines, the record is emitted after the timeout.
+	rec, err := r()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := `first\n  continued`+"\n", string(rec); want != have {
+		t.Fatalf("want %q, have %q", want, have)
+	}
+
+	pw.Close()
+	if _, err := r(); err != io.EOF {
+		t.Fatalf("want EOF, have %v", err)
+	}
+}
+
+func TestLineReader(t *testing.T) {
+	r := NewLineReader(bytes.NewBufferString("one\r\ntwo\n\nthree"))
+	var res []string
+	for {
+		rec, err := r()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		res = append(res, string(rec))
+	}
+	if want := []string{"one\n", "two\n", "\n", "three\n"}; !reflect.DeepEqual(want, res) {
+		t.Fatalf("want %q, have %q", want, res)
+	}
+}
@@ -35,6 +35,27 @@ func NewDynamicReader(r io.Reader) Reader {
 	}
 }
 
+// NewLineReader returns a record reader that emits each line from r, without
+// a topic, for clients that leave topics to the ingester. Like bufio.ScanLines,
+// it drops carriage returns, and accepts a final line without a newline.
+func NewLineReader(r io.Reader) Reader {
+	br := bufio.NewReader(r)
+
+	return func() ([]byte, error) {
+		l, err := br.ReadBytes('\n')
+		if err == io.EOF && len(l) > 0 {
+			l, err = append(l, '\n'), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if n := len(l); n >= 2 && l[n-2] == '\r' {
+			l = append(l[:n-2], '\n')
+		}
+		return l, nil
+	}
+}
+
 // StaticReaderFactory returns a RecordReaderFactory that prefixes all records
 // with the given bytes as topic.
 // Callers must ensure the topic identifier is valid.
@@ -49,7 +70,7 @@ func StaticReaderFactory(topic []byte) ReaderFactory {
 			if err != nil {
 				return nil, err
 			}
-			return append(topic, l...), nil
+			return append(topic[:len(topic):len(topic)], l...), nil // a new record each time
 		}
 	}
 }
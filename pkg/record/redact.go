@@ -0,0 +1,264 @@
+package record
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RedactMask replaces what a redaction rule matches.
+const RedactMask = "[REDACTED]"
+
+// Built-in detectors for redaction rules.
+const (
+	DetectPAN    = "pan"    // payment card numbers, passing the Luhn check
+	DetectEmail  = "email"  // email addresses
+	DetectJWT    = "jwt"    // JSON web tokens
+	DetectBearer = "bearer" // tokens following "Bearer", as in Authorization headers
+	DetectIPv4   = "ipv4"   // dotted-quad IPv4 addresses
+)
+
+var detectors = map[string]struct {
+	re    *regexp.Regexp
+	valid func(rec []byte, start, end int) bool
+}{
+	DetectPAN:    {regexp.MustCompile(`\b(?:\d{4}[ -]?){3}\d{1,7}\b`), luhn},
+	DetectEmail:  {regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`), nil},
+	DetectJWT:    {regexp.MustCompile(`\beyJ[A-Za-z0-9_-]*\.eyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]*`), nil},
+	DetectBearer: {regexp.MustCompile(`(?i)\bbearer\s+([A-Za-z0-9._~+/-]+=*)`), nil},
+	DetectIPv4:   {regexp.MustCompile(`\b(?:(?:25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)\.){3}(?:25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)\b`), standaloneIPv4},
+}
+
+// Redactor masks or hashes sensitive data in records, e.g. card numbers,
+// email addresses, and tokens, so it's never written to segments. Rules are
+// applied in order, each to the output of the last.
+type Redactor struct {
+	rules []redactRule
+	key   []byte
+}
+
+type redactRule struct {
+	re         *regexp.Regexp
+	valid      func(rec []byte, start, end int) bool // of a match in rec, if not nil
+	hash       bool                                  // replace matches with a hash, rather than mask them
+	redactions prometheus.Counter
+}
+
+// ParseRedactor reads redaction rules, one per line:
+//
+//	# comments and blank lines are ignored
+//	<name> <mask|hash> <pan|email|jwt|bearer|ipv4>
+//	<name> <mask|hash> regexp <expression>
+//	key <secret>
+//
+// Masked matches are replaced with RedactMask. Hashed matches are replaced
+// with a truncated HMAC-SHA256 of the match, so equal values can still be
+// correlated. The key is required with hash rules, as without one, values
+// with few possibilities, e.g. IP addresses, are easily found from their
+// hashes; keep it, and so the rules, secret. If an expression has subexpressions,
+// only what the first one matches is replaced, e.g. password=(\S+). Each
+// redaction is counted in redactions, labeled with the rule name.
+func ParseRedactor(r io.Reader, redactions *prometheus.CounterVec) (*Redactor, error) {
+	var (
+		rd    = &Redactor{}
+		names = map[string]bool{}
+		s     = bufio.NewScanner(r)
+	)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if fields[0] == "key" {
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("line %d: want key <secret>", n)
+			}
+			rd.key = []byte(fields[1])
+			continue
+		}
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("line %d: want <name> <mask|hash> <detector>", n)
+		}
+		name := fields[0]
+		if names[name] {
+			return nil, fmt.Errorf("line %d: rule %q repeated", n, name)
+		}
+		names[name] = true
+
+		var rule redactRule
+		switch fields[1] {
+		case "mask":
+		case "hash":
+			rule.hash = true
+		default:
+			return nil, fmt.Errorf("line %d: replacement %q invalid, must be mask or hash", n, fields[1])
+		}
+		if fields[2] == "regexp" {
+			// The expression is the rest of the line, spaces and all.
+			expr := line
+			for i := 0; i < 3; i++ {
+				expr = strings.TrimLeft(strings.TrimLeftFunc(expr, isNotSpace), " \t")
+			}
+			if expr == "" {
+				return nil, fmt.Errorf("line %d: want regexp <expression>", n)
+			}
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, errors.Wrapf(err, "line %d", n)
+			}
+			rule.re = re
+		} else {
+			d, ok := detectors[fields[2]]
+			if !ok || len(fields) > 3 {
+				return nil, fmt.Errorf("line %d: detector %q invalid, must be %s, %s, %s, %s, %s, or regexp <expression>", n, strings.Join(fields[2:], " "), DetectPAN, DetectEmail, DetectJWT, DetectBearer, DetectIPv4)
+			}
+			rule.re, rule.valid = d.re, d.valid
+		}
+		rule.redactions = redactions.WithLabelValues(name)
+		rd.rules = append(rd.rules, rule)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	for _, rule := range rd.rules {
+		if rule.hash && len(rd.key) <= 0 {
+			return nil, errors.New("hash rules require a key <secret> line")
+		}
+	}
+	return rd, nil
+}
+
+// Redact returns the record with every rule applied. The record is returned
+// as is if nothing matches.
+func (rd *Redactor) Redact(rec []byte) []byte {
+	return rd.redact(rec, 0)
+}
+
+// RedactAfterTopic is like Redact, but leaves the space-delimited topic of
+// the record as is.
+func (rd *Redactor) RedactAfterTopic(rec []byte) []byte {
+	return rd.redact(rec, bytes.IndexByte(rec, ' ')+1)
+}
+
+// redact applies every rule to rec[from:].
+func (rd *Redactor) redact(rec []byte, from int) []byte {
+	for _, rule := range rd.rules {
+		rec = rd.apply(rule, rec, from)
+	}
+	return rec
+}
+
+func (rd *Redactor) apply(rule redactRule, rec []byte, from int) []byte {
+	matches := rule.re.FindAllSubmatchIndex(rec[from:], -1)
+	if len(matches) <= 0 {
+		return rec
+	}
+	var (
+		out  []byte
+		last int
+		n    int
+	)
+	for _, m := range matches {
+		start, end := m[0], m[1]
+		if len(m) >= 4 && m[2] >= 0 {
+			start, end = m[2], m[3] // the first subexpression
+		}
+		start, end = from+start, from+end
+		if rule.valid != nil && !rule.valid(rec, start, end) {
+			continue
+		}
+		out = append(out, rec[last:start]...)
+		out = append(out, rd.replace(rule, rec[start:end])...)
+		last = end
+		n++
+	}
+	if n <= 0 {
+		return rec
+	}
+	rule.redactions.Add(float64(n))
+	return append(out, rec[last:]...)
+}
+
+func (rd *Redactor) replace(rule redactRule, match []byte) []byte {
+	if !rule.hash {
+		return []byte(RedactMask)
+	}
+	h := hmac.New(sha256.New, rd.key)
+	h.Write(match)
+	return []byte("hmac-sha256:" + hex.EncodeToString(h.Sum(nil)[:8]))
+}
+
+// RedactReaderFactory wraps rfac, so records its readers return are redacted
+// by rd. With skipTopic, the space-delimited topic of each record is left as
+// is, as for NewDynamicReader and StaticReaderFactory.
+func RedactReaderFactory(rfac ReaderFactory, rd *Redactor, skipTopic bool) ReaderFactory {
+	if rd == nil || len(rd.rules) <= 0 {
+		return rfac
+	}
+	return func(r io.Reader) Reader {
+		read := rfac(r)
+		return func() ([]byte, error) {
+			rec, err := read()
+			if err != nil {
+				return rec, err
+			}
+			if skipTopic {
+				return rd.RedactAfterTopic(rec), nil
+			}
+			return rd.Redact(rec), nil
+		}
+	}
+}
+
+func isNotSpace(r rune) bool { return r != ' ' && r != '\t' }
+
+// standaloneIPv4 reports whether an IPv4 address in rec isn't part of a
+// longer dotted string of numbers, e.g. a version.
+func standaloneIPv4(rec []byte, start, end int) bool {
+	if start >= 2 && rec[start-1] == '.' && isDigit(rec[start-2]) {
+		return false
+	}
+	if end+1 < len(rec) && rec[end] == '.' && isDigit(rec[end+1]) {
+		return false
+	}
+	return true
+}
+
+// luhn reports whether the digits in the match, ignoring spaces and dashes,
+// are 13 to 19 long and pass the Luhn check, as payment card numbers do.
+func luhn(rec []byte, start, end int) bool {
+	var (
+		b           = rec[start:end]
+		sum, digits int
+	)
+	for i := len(b) - 1; i >= 0; i-- {
+		c := b[i]
+		if c == ' ' || c == '-' {
+			continue
+		}
+		if !isDigit(c) {
+			return false
+		}
+		d := int(c - '0')
+		if digits%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		digits++
+	}
+	return digits >= 13 && digits <= 19 && sum%10 == 0
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
@@ -0,0 +1,239 @@
+package record
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+)
+
+// ErrInvalidSyslog is returned if a syslog message has no valid priority.
+var ErrInvalidSyslog = errors.New("invalid syslog message")
+
+// maxSyslogMessage bounds frames when no maximum is given, so a bad length or
+// a missing newline can't make us allocate without limit. RFC 5425 asks
+// receivers to support at least 8 KB.
+const maxSyslogMessage = 64 * 1024
+
+// maxSyslogLengthDigits bounds the MSG-LEN of octet-counted frames, which
+// would otherwise be read without limit.
+const maxSyslogLengthDigits = 10
+
+// SyslogMessage is the parsed header of a syslog message.
+type SyslogMessage struct {
+	Facility int
+	Severity int
+	AppName  string
+}
+
+// ParseSyslog parses the header of an RFC 5424 or RFC 3164 syslog message.
+// An AppName that can't be determined is left empty.
+func ParseSyslog(b []byte) (SyslogMessage, error) {
+	var m SyslogMessage
+	if len(b) < 3 || b[0] != '<' {
+		return m, ErrInvalidSyslog
+	}
+	end := bytes.IndexByte(b, '>')
+	if end < 2 || end > 4 {
+		return m, ErrInvalidSyslog
+	}
+	pri, err := strconv.Atoi(string(b[1:end]))
+	if err != nil || pri < 0 || pri > 191 {
+		return m, ErrInvalidSyslog
+	}
+	m.Facility, m.Severity = pri/8, pri%8
+	rest := b[end+1:]
+
+	// RFC 5424: VERSION SP TIMESTAMP SP HOSTNAME SP APP-NAME SP ...
+	if len(rest) >= 2 && '1' <= rest[0] && rest[0] <= '9' && rest[1] == ' ' {
+		if fields := bytes.SplitN(rest, []byte{' '}, 5); len(fields) >= 4 && string(fields[3]) != "-" {
+			m.AppName = string(fields[3])
+		}
+		return m, nil
+	}
+
+	// RFC 3164: TIMESTAMP SP [HOSTNAME SP] TAG[PID]: MSG
+	// The timestamp is fixed-width, e.g. "Jan  2 15:04:05".
+	if len(rest) < 16 || rest[15] != ' ' {
+		return m, nil // no recognizable header
+	}
+	fields := bytes.Fields(rest[16:])
+	if len(fields) <= 0 {
+		return m, nil
+	}
+	tag := fields[0]
+	if !isSyslogTag(tag) && len(fields) > 1 {
+		tag = fields[1] // the first field was the hostname
+	}
+	if i := bytes.IndexAny(tag, "[:"); i >= 0 {
+		tag = tag[:i]
+	}
+	m.AppName = string(tag)
+	return m, nil
+}
+
+func isSyslogTag(b []byte) bool {
+	return bytes.IndexAny(b, "[:") >= 0
+}
+
+// SyslogTopicFunc maps a syslog message to a valid topic.
+type SyslogTopicFunc func(SyslogMessage) []byte
+
+// SyslogAppNameTopic maps messages to topics by their app-name. Characters not
+// allowed in topics are replaced by underscores. Messages without an app-name
+// get the fallback topic, which callers must ensure is valid.
+func SyslogAppNameTopic(fallback []byte) SyslogTopicFunc {
+	return func(m SyslogMessage) []byte {
+		topic := []byte(m.AppName)
+		for len(topic) > 0 && !isAlphanumeric(topic[0]) {
+			topic = topic[1:]
+		}
+		for i, c := range topic {
+			if !isAlphanumeric(c) && c != '-' {
+				topic[i] = '_'
+			}
+		}
+		if len(topic) <= 0 {
+			return fallback
+		}
+		return topic
+	}
+}
+
+var syslogFacilities = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "audit", "alert", "clock",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+// SyslogFacilityTopic maps messages to topics by their facility name,
+// e.g. kern, auth, or local0.
+func SyslogFacilityTopic(m SyslogMessage) []byte {
+	if m.Facility < 0 || m.Facility >= len(syslogFacilities) {
+		return []byte("unknown")
+	}
+	return []byte(syslogFacilities[m.Facility])
+}
+
+// SyslogRecord converts a single syslog message to a record, with a topic
+// given by topic. Messages without a valid header are treated as user.notice,
+// per RFC 3164. Trailing newlines are removed, and embedded newlines are
+// replaced by spaces, to keep one record per line.
+func SyslogRecord(msg []byte, topic SyslogTopicFunc) []byte {
+	m, err := ParseSyslog(msg)
+	if err != nil {
+		m = SyslogMessage{Facility: 1, Severity: 5}
+	}
+	msg = bytes.TrimRight(msg, "\r\n")
+	t := topic(m)
+	rec := make([]byte, 0, len(t)+1+len(msg)+1)
+	rec = append(rec, t...)
+	rec = append(rec, ' ')
+	for _, c := range msg {
+		if c == '\n' {
+			c = ' '
+		}
+		rec = append(rec, c)
+	}
+	return append(rec, '\n')
+}
+
+// SyslogReaderFactory returns a ReaderFactory for syslog messages sent over a
+// stream, e.g. TCP. Each message may be framed by octet counting, as in RFC
+// 6587, or terminated by a newline. Frames are capped at max bytes, or at
+// maxSyslogMessage if max is zero: longer octet-counted frames are invalid,
+// as are lengths of more than 10 digits, and longer newline-terminated ones
+// are truncated. A final message without a newline is read at EOF.
+func SyslogReaderFactory(topic SyslogTopicFunc, max int) ReaderFactory {
+	if max <= 0 {
+		max = maxSyslogMessage
+	}
+	return func(r io.Reader) Reader {
+		br := bufio.NewReader(r)
+
+		return func() ([]byte, error) {
+			for {
+				b, err := br.Peek(1)
+				if err != nil {
+					return nil, err
+				}
+				switch {
+				case '1' <= b[0] && b[0] <= '9':
+					// Octet counting: MSG-LEN SP SYSLOG-MSG
+					n, err := readFrameLength(br)
+					if err != nil {
+						return nil, err
+					}
+					if n > max {
+						return nil, ErrInvalidSyslog
+					}
+					msg := make([]byte, n)
+					if _, err := io.ReadFull(br, msg); err != nil {
+						return nil, err
+					}
+					return SyslogRecord(msg, topic), nil
+
+				case b[0] == '\n' || b[0] == '\r':
+					br.ReadByte() // skip stray line endings between frames
+
+				default:
+					// Non-transparent framing: SYSLOG-MSG LF
+					msg, err := readLimitedLine(br, max)
+					if err != nil {
+						return nil, err
+					}
+					return SyslogRecord(msg, topic), nil
+				}
+			}
+		}
+	}
+}
+
+// readFrameLength reads the MSG-LEN SP prefix of an octet-counted frame, of
+// at most maxSyslogLengthDigits digits.
+func readFrameLength(br *bufio.Reader) (int, error) {
+	var n int
+	for i := 0; ; i++ {
+		c, err := br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if c == ' ' && i > 0 {
+			return n, nil
+		}
+		if c < '0' || c > '9' || i >= maxSyslogLengthDigits {
+			return 0, ErrInvalidSyslog
+		}
+		n = n*10 + int(c-'0')
+	}
+}
+
+// readLimitedLine reads through the next newline, or to EOF, keeping at most
+// max bytes of the line.
+func readLimitedLine(br *bufio.Reader, max int) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := br.ReadSlice('\n')
+		if room := max - len(line); room > 0 {
+			if len(chunk) > room {
+				chunk = chunk[:room]
+			}
+			line = append(line, chunk...)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF && len(line) > 0 {
+			return line, nil // the last line, unterminated
+		}
+		if err != nil {
+			return nil, err
+		}
+		return line, nil
+	}
+}
+
+func isAlphanumeric(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
@@ -0,0 +1,164 @@
+package record
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestParseSyslog(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		input string
+		want  SyslogMessage
+		err   error
+	}{
+		{
+			name:  "rfc5424",
+			input: "<34>1 2003-10-11T22:14:15.003Z mymachine.example.com su - ID47 - 'su root' failed",
+			want:  SyslogMessage{Facility: 4, Severity: 2, AppName: "su"},
+		}, {
+			name:  "rfc5424-nil-app-name",
+			input: "<165>1 2003-08-24T05:14:15.000003-07:00 192.0.2.1 - 8710 - - msg",
+			want:  SyslogMessage{Facility: 20, Severity: 5},
+		}, {
+			name:  "rfc3164",
+			input: "<13>Feb  5 17:32:18 10.0.0.99 myproc[10]: hello",
+			want:  SyslogMessage{Facility: 1, Severity: 5, AppName: "myproc"},
+		}, {
+			name:  "rfc3164-no-hostname",
+			input: "<86>Oct 11 22:14:15 sshd: accepted",
+			want:  SyslogMessage{Facility: 10, Severity: 6, AppName: "sshd"},
+		}, {
+			name:  "no-priority",
+			input: "hello",
+			err:   ErrInvalidSyslog,
+		}, {
+			name:  "bad-priority",
+			input: "<999>1 - - - - - -",
+			err:   ErrInvalidSyslog,
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			m, err := ParseSyslog([]byte(c.input))
+			if err != c.err {
+				t.Fatalf("err: want %v, have %v", c.err, err)
+			}
+			if err == nil && m != c.want {
+				t.Fatalf("want %+v, have %+v", c.want, m)
+			}
+		})
+	}
+}
+
+func TestSyslogTopics(t *testing.T) {
+	appName := SyslogAppNameTopic([]byte("syslog"))
+	for input, want := range map[string]string{
+		"nginx":       "nginx",
+		"my.app/v2":   "my_app_v2",
+		"-dash-first": "dash-first",
+		"":            "syslog",
+		"...":         "syslog",
+	} {
+		topic := appName(SyslogMessage{AppName: input})
+		if string(topic) != want {
+			t.Errorf("%q: want %q, have %q", input, want, topic)
+		}
+		if !IsValidTopic(topic) {
+			t.Errorf("%q: %q is not a valid topic", input, topic)
+		}
+	}
+	if want, have := "local3", string(SyslogFacilityTopic(SyslogMessage{Facility: 19})); want != have {
+		t.Errorf("facility: want %q, have %q", want, have)
+	}
+}
+
+func TestSyslogReader(t *testing.T) {
+	var (
+		m1    = "<34>1 2003-10-11T22:14:15.003Z host su - ID47 - line one\nline two"
+		m2    = "<13>Feb  5 17:32:18 host cron[1]: tick"
+		input = "65 " + m1 + "\n" + m2 + "\n"
+		want  = []string{
+			"su <34>1 2003-10-11T22:14:15.003Z host su - ID47 - line one line two\n",
+			"cron <13>Feb  5 17:32:18 host cron[1]: tick\n",
+		}
+	)
+	if len(m1) != 65 {
+		t.Fatalf("test message has length %d", len(m1))
+	}
+
+	r := SyslogReaderFactory(SyslogAppNameTopic([]byte("syslog")), 0)(bytes.NewBufferString(input))
+	var have []string
+	for {
+		rec, err := r()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		have = append(have, string(rec))
+	}
+	if !reflect.DeepEqual(want, have) {
+		t.Fatalf("want %q, have %q", want, have)
+	}
+}
+
+func TestSyslogReaderMaxSize(t *testing.T) {
+	input := "<13>0123456789abcdefghij\n<13>short\n30 <13>0123456789abcdefghijklmnop"
+	r := SyslogReaderFactory(SyslogAppNameTopic([]byte("syslog")), 20)(bytes.NewBufferString(input))
+	for _, want := range []string{
+		"syslog <13>0123456789abcdef\n", // truncated
+		"syslog <13>short\n",
+	} {
+		rec, err := r()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have := string(rec); want != have {
+			t.Errorf("want %q, have %q", want, have)
+		}
+	}
+	if _, err := r(); err != ErrInvalidSyslog {
+		t.Errorf("oversized octet-counted frame: want %v, have %v", ErrInvalidSyslog, err)
+	}
+}
+
+func TestSyslogReaderFraming(t *testing.T) {
+	// A final message without a newline is read at EOF.
+	r := SyslogReaderFactory(SyslogAppNameTopic([]byte("syslog")), 0)(bytes.NewBufferString("<13>first\n<13>last"))
+	for _, want := range []string{"syslog <13>first\n", "syslog <13>last\n"} {
+		rec, err := r()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have := string(rec); want != have {
+			t.Errorf("want %q, have %q", want, have)
+		}
+	}
+	if _, err := r(); err != io.EOF {
+		t.Errorf("want %v, have %v", io.EOF, err)
+	}
+
+	// Lengths are read up to 10 digits, however many are sent.
+	for _, input := range []io.Reader{
+		bytes.NewBufferString("12345678901 <13>x"),
+		digits{},
+	} {
+		r := SyslogReaderFactory(SyslogAppNameTopic([]byte("syslog")), 0)(input)
+		if _, err := r(); err != ErrInvalidSyslog {
+			t.Errorf("want %v, have %v", ErrInvalidSyslog, err)
+		}
+	}
+}
+
+// digits is an endless stream of digits.
+type digits struct{}
+
+func (digits) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = '1'
+	}
+	return len(p), nil
+}
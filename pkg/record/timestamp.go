@@ -0,0 +1,98 @@
+package record
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+)
+
+// TimestampFunc reads the time an event occurred from its record, which
+// starts with a space-delimited topic. It returns false if there's none.
+type TimestampFunc func(record []byte) (time.Time, bool)
+
+// RFC3339Timestamp reads an RFC 3339 timestamp, with optional fractional
+// seconds, from the start of the record's payload, e.g.
+//
+//	topic 2017-04-01T12:34:56.789Z something happened
+func RFC3339Timestamp(record []byte) (time.Time, bool) {
+	payload := payloadOf(record)
+	if i := bytes.IndexAny(payload, " \t"); i >= 0 {
+		payload = payload[:i]
+	}
+	return parseTimestamp(payload)
+}
+
+// LogfmtTimestamp reads the RFC 3339 value of the first ts key from a logfmt
+// payload, e.g.
+//
+//	topic level=info ts=2017-04-01T12:34:56.789Z msg="something happened"
+func LogfmtTimestamp(record []byte) (time.Time, bool) {
+	payload := payloadOf(record)
+	for {
+		i := bytes.Index(payload, []byte("ts="))
+		if i < 0 {
+			return time.Time{}, false
+		}
+		if i > 0 && payload[i-1] != ' ' && payload[i-1] != '\t' {
+			payload = payload[i+3:] // e.g. hosts=
+			continue
+		}
+		value := payload[i+3:]
+		if len(value) > 0 && value[0] == '"' {
+			value = value[1:]
+			if j := bytes.IndexByte(value, '"'); j >= 0 {
+				value = value[:j]
+			}
+		} else if j := bytes.IndexAny(value, " \t"); j >= 0 {
+			value = value[:j]
+		}
+		return parseTimestamp(value)
+	}
+}
+
+// JSONTimestamp reads the RFC 3339 value of the top-level time key from a
+// JSON object payload, e.g.
+//
+//	topic {"time":"2017-04-01T12:34:56.789Z","msg":"something happened"}
+func JSONTimestamp(record []byte) (time.Time, bool) {
+	payload := bytes.TrimSpace(payloadOf(record))
+	if len(payload) <= 0 || payload[0] != '{' {
+		return time.Time{}, false
+	}
+	var v struct {
+		Time string `json:"time"`
+	}
+	if err := json.Unmarshal(payload, &v); err != nil {
+		return time.Time{}, false
+	}
+	return parseTimestamp([]byte(v.Time))
+}
+
+// AnyTimestamp reads a timestamp in any of the formats above.
+func AnyTimestamp(record []byte) (time.Time, bool) {
+	for _, f := range []TimestampFunc{JSONTimestamp, RFC3339Timestamp, LogfmtTimestamp} {
+		if t, ok := f(record); ok {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// payloadOf strips the topic and trailing newline from the record.
+func payloadOf(record []byte) []byte {
+	if i := bytes.IndexByte(record, ' '); i >= 0 {
+		record = record[i+1:]
+	}
+	return bytes.TrimRight(record, "\r\n")
+}
+
+func parseTimestamp(b []byte) (time.Time, bool) {
+	if len(b) <= 0 {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, string(b))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
@@ -0,0 +1,45 @@
+package record
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimestampFuncs(t *testing.T) {
+	var (
+		ts   = time.Date(2017, 4, 1, 12, 34, 56, 789000000, time.UTC)
+		none = time.Time{}
+	)
+	for _, testcase := range []struct {
+		name   string
+		f      TimestampFunc
+		record string
+		want   time.Time
+	}{
+		{"rfc3339", RFC3339Timestamp, "t 2017-04-01T12:34:56.789Z hello\n", ts},
+		{"rfc3339 offset", RFC3339Timestamp, "t 2017-04-01T14:34:56.789+02:00 hello\n", ts},
+		{"rfc3339 only", RFC3339Timestamp, "t 2017-04-01T12:34:56.789Z\n", ts},
+		{"rfc3339 missing", RFC3339Timestamp, "t hello 2017-04-01T12:34:56.789Z\n", none},
+		{"logfmt", LogfmtTimestamp, "t level=info ts=2017-04-01T12:34:56.789Z msg=hello\n", ts},
+		{"logfmt first", LogfmtTimestamp, "t ts=2017-04-01T12:34:56.789Z\n", ts},
+		{"logfmt quoted", LogfmtTimestamp, "t ts=\"2017-04-01T12:34:56.789Z\" msg=hello\n", ts},
+		{"logfmt other key", LogfmtTimestamp, "t hosts=2017-04-01T12:34:56.789Z ts=2017-04-01T12:34:56.789Z\n", ts},
+		{"logfmt invalid", LogfmtTimestamp, "t ts=yesterday\n", none},
+		{"json", JSONTimestamp, "t {\"msg\":\"hello\",\"time\":\"2017-04-01T12:34:56.789Z\"}\n", ts},
+		{"json nested", JSONTimestamp, "t {\"msg\":{\"time\":\"2017-04-01T12:34:56.789Z\"}}\n", none},
+		{"json invalid", JSONTimestamp, "t {\"time\":\n", none},
+		{"any json", AnyTimestamp, "t {\"time\":\"2017-04-01T12:34:56.789Z\"}\n", ts},
+		{"any logfmt", AnyTimestamp, "t msg=hello ts=2017-04-01T12:34:56.789Z\n", ts},
+		{"any none", AnyTimestamp, "t hello\n", none},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			have, ok := testcase.f([]byte(testcase.record))
+			if want := !testcase.want.IsZero(); want != ok {
+				t.Fatalf("ok: want %v, have %v", want, ok)
+			}
+			if !testcase.want.Equal(have) {
+				t.Errorf("want %v, have %v", testcase.want, have)
+			}
+		})
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"net/http"
+	"net/url"
 	"strings"
 	"sync"
 	"time"
@@ -28,6 +29,7 @@ type Consumer struct {
 	segmentTargetAge   time.Duration
 	segmentDelay       time.Duration
 	replicationFactor  int
+	priorityTopics     []string            // consumed first, if ingesters write segments per topic
 	gatherErrors       int                 // heuristic to move out of gather state
 	pending            map[string][]string // ingester: segment IDs
 	active             *bytes.Buffer       // merged pending segments
@@ -40,7 +42,8 @@ type Consumer struct {
 	reporter           EventReporter
 }
 
-// NewConsumer creates a consumer.
+// NewConsumer creates a consumer. Segments of the priority topics, if any,
+// are consumed before others, from ingesters writing segments per topic.
 // Don't forget to Run it.
 func NewConsumer(
 	peer *cluster.Peer,
@@ -49,6 +52,7 @@ func NewConsumer(
 	segmentTargetAge time.Duration,
 	segmentDelay time.Duration,
 	replicationFactor int,
+	priorityTopics []string,
 	consumedSegments, consumedBytes prometheus.Counter,
 	replicatedSegments, replicatedBytes prometheus.Counter,
 	reporter EventReporter,
@@ -60,6 +64,7 @@ func NewConsumer(
 		segmentTargetAge:   segmentTargetAge,
 		segmentDelay:       segmentDelay,
 		replicationFactor:  replicationFactor,
+		priorityTopics:     priorityTopics,
 		gatherErrors:       0,
 		pending:            map[string][]string{},
 		active:             &bytes.Buffer{},
@@ -139,41 +144,22 @@ func (c *Consumer) gather() stateFn {
 		return c.replicate
 	}
 
-	// Get the oldest segment ID from a random ingester.
-	instance := instances[rand.Intn(len(instances))]
-	nextResp, err := c.client.Get(fmt.Sprintf("http://%s/ingest%s", instance, ingest.APIPathNext))
-	if err != nil {
-		c.reporter.ReportEvent(Event{
-			Op: "gather", Warning: err,
-			Msg: fmt.Sprintf("ingester %s, during %s: fatal error", instance, ingest.APIPathNext),
-		})
-		c.gatherErrors++
-		return c.gather
+	// Get the oldest segment ID from a random ingester, of the priority
+	// topics, if it has any, or else of any topic.
+	var (
+		instance   = instances[rand.Intn(len(instances))]
+		nextID, ok = "", false
+	)
+	if len(c.priorityTopics) > 0 {
+		nextID, ok = c.next(instance, c.priorityTopics)
 	}
-	defer nextResp.Body.Close()
-	nextRespBody, err := ioutil.ReadAll(nextResp.Body)
-	if err != nil {
-		c.reporter.ReportEvent(Event{
-			Op: "gather", Warning: err,
-			Msg: fmt.Sprintf("ingester %s, during %s: read error", instance, ingest.APIPathNext),
-		})
-		c.gatherErrors++
-		return c.gather
+	if !ok {
+		nextID, ok = c.next(instance, nil)
 	}
-	nextID := strings.TrimSpace(string(nextRespBody))
-	if nextResp.StatusCode == http.StatusNotFound {
-		// Normal, when the ingester has no more segments to give right now.
+	if !ok {
 		c.gatherErrors++ // after enough of these errors, we should replicate
 		return c.gather
 	}
-	if nextResp.StatusCode != http.StatusOK {
-		c.reporter.ReportEvent(Event{
-			Op: "gather", Warning: fmt.Errorf(nextResp.Status),
-			Msg: fmt.Sprintf("ingester %s, during %s: bad response code", instance, ingest.APIPathNext),
-		})
-		c.gatherErrors++
-		return c.gather
-	}
 
 	// Mark the segment ID as pending.
 	// From this point forward, we must either commit or fail the segment.
@@ -227,6 +213,45 @@ func (c *Consumer) gather() stateFn {
 	return c.gather
 }
 
+// next returns the ID of the oldest segment on the ingester, of the topics,
+// if any are given. It returns false if there's none, or if the request
+// failed, which is reported.
+func (c *Consumer) next(instance string, topics []string) (string, bool) {
+	u := fmt.Sprintf("http://%s/ingest%s", instance, ingest.APIPathNext)
+	if len(topics) > 0 {
+		u += "?" + url.Values{"topic": topics}.Encode()
+	}
+	resp, err := c.client.Get(u)
+	if err != nil {
+		c.reporter.ReportEvent(Event{
+			Op: "gather", Warning: err,
+			Msg: fmt.Sprintf("ingester %s, during %s: fatal error", instance, ingest.APIPathNext),
+		})
+		return "", false
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		c.reporter.ReportEvent(Event{
+			Op: "gather", Warning: err,
+			Msg: fmt.Sprintf("ingester %s, during %s: read error", instance, ingest.APIPathNext),
+		})
+		return "", false
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return strings.TrimSpace(string(body)), true
+	case http.StatusNotFound:
+		return "", false // normal, when the ingester has no more segments to give right now
+	default:
+		c.reporter.ReportEvent(Event{
+			Op: "gather", Warning: fmt.Errorf(resp.Status),
+			Msg: fmt.Sprintf("ingester %s, during %s: bad response code", instance, ingest.APIPathNext),
+		})
+		return "", false
+	}
+}
+
 func (c *Consumer) replicate() stateFn {
 	// Replicate the segment to the cluster.
 	var (